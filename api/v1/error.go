@@ -0,0 +1,36 @@
+package log_v1
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCStatus lets the gRPC server send the error with an OutOfRange
+// code and the error itself attached as a detail, so clients can get
+// back the offset they asked for and the range the log has.
+func (e *ErrOffsetOutOfRange) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.OutOfRange,
+		fmt.Sprintf("offset out of range: %d", e.Offset),
+	)
+	std, err := st.WithDetails(e)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e *ErrOffsetOutOfRange) Error() string {
+	if e.Next == e.Lowest {
+		return fmt.Sprintf(
+			"offset out of range: %d (log has no offsets, next is %d)",
+			e.Offset, e.Next,
+		)
+	}
+	return fmt.Sprintf(
+		"offset out of range: %d (log has offsets %d to %d)",
+		e.Offset, e.Lowest, e.Highest,
+	)
+}
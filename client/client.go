@@ -0,0 +1,133 @@
+// Package client is a Go client for the log's gRPC service.
+package client
+
+import (
+	"context"
+
+	api "github.com/jimxshaw/loglib/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Client produces records to and consumes records from a log server.
+type Client struct {
+	conn *grpc.ClientConn
+	log  api.LogClient
+}
+
+// New connects to the log server at the given address.
+func New(addr string, opts ...grpc.DialOption) (*Client, error) {
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		conn: conn,
+		log:  api.NewLogClient(conn),
+	}, nil
+}
+
+// Produce appends a record with the given value and returns its offset.
+func (c *Client) Produce(ctx context.Context, value []byte) (uint64, error) {
+	res, err := c.log.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: value},
+	})
+	if err != nil {
+		return 0, fromStatus(err)
+	}
+	return res.Offset, nil
+}
+
+// Consume reads the record at the given offset. Asking for an offset
+// the log doesn't have returns an *api.ErrOffsetOutOfRange.
+func (c *Client) Consume(ctx context.Context, offset uint64) (*api.Record, error) {
+	res, err := c.log.Consume(ctx, &api.ConsumeRequest{Offset: offset})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return res.Record, nil
+}
+
+// ProduceStream opens a stream to append many records without waiting
+// for each one's offset before sending the next.
+func (c *Client) ProduceStream(ctx context.Context) (*ProduceStream, error) {
+	stream, err := c.log.ProduceStream(ctx)
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return &ProduceStream{stream: stream}, nil
+}
+
+// ConsumeStream opens a stream of the records from the given offset
+// onwards. It keeps delivering records as they're appended until the
+// context is cancelled.
+func (c *Client) ConsumeStream(ctx context.Context, offset uint64) (*ConsumeStream, error) {
+	stream, err := c.log.ConsumeStream(ctx, &api.ConsumeRequest{Offset: offset})
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return &ConsumeStream{stream: stream}, nil
+}
+
+// Close closes the connection to the server.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// ProduceStream sends records to be appended and receives their
+// offsets, in the order the records were sent.
+type ProduceStream struct {
+	stream api.Log_ProduceStreamClient
+}
+
+// Send sends a record with the given value to be appended.
+func (s *ProduceStream) Send(value []byte) error {
+	err := s.stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: value},
+	})
+	return fromStatus(err)
+}
+
+// Recv receives the offset of the next record sent.
+func (s *ProduceStream) Recv() (uint64, error) {
+	res, err := s.stream.Recv()
+	if err != nil {
+		return 0, fromStatus(err)
+	}
+	return res.Offset, nil
+}
+
+// CloseSend tells the server no more records will be sent.
+func (s *ProduceStream) CloseSend() error {
+	return s.stream.CloseSend()
+}
+
+// ConsumeStream receives records from the log in order.
+type ConsumeStream struct {
+	stream api.Log_ConsumeStreamClient
+}
+
+// Recv receives the next record, waiting for one to be appended if
+// the stream has caught up with the log.
+func (s *ConsumeStream) Recv() (*api.Record, error) {
+	res, err := s.stream.Recv()
+	if err != nil {
+		return nil, fromStatus(err)
+	}
+	return res.Record, nil
+}
+
+// fromStatus gets back the typed error the server attached to the
+// status, if there is one, so callers can use errors.As on it.
+func fromStatus(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, detail := range st.Details() {
+		if e, ok := detail.(*api.ErrOffsetOutOfRange); ok {
+			return e
+		}
+	}
+	return err
+}
@@ -0,0 +1,199 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	api "github.com/jimxshaw/loglib/api/v1"
+	"github.com/jimxshaw/loglib/internal/log"
+	"github.com/jimxshaw/loglib/internal/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestClient(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, client *Client){
+		"produce and consume":            testProduceConsume,
+		"out of range error has a range": testOutOfRange,
+		"produce and consume streams":    testStreams,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			client, teardown := setupTest(t)
+			defer teardown()
+			fn(t, client)
+		})
+	}
+}
+
+func setupTest(t *testing.T) (*Client, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "client-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	client, teardown := serve(t, clog)
+	return client, func() {
+		teardown()
+		clog.Remove()
+	}
+}
+
+// serve serves the log on a local port and
+// returns a client connected to it.
+func serve(t *testing.T, clog server.CommitLog) (*Client, func()) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv, err := server.NewGRPCServer(&server.Config{CommitLog: clog})
+	require.NoError(t, err)
+	go func() {
+		srv.Serve(l)
+	}()
+
+	client, err := New(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+
+	return client, func() {
+		client.Close()
+		srv.Stop()
+	}
+}
+
+func testProduceConsume(t *testing.T, client *Client) {
+	ctx := context.Background()
+
+	offset, err := client.Produce(ctx, []byte("hello world"))
+	require.NoError(t, err)
+
+	record, err := client.Consume(ctx, offset)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	require.Equal(t, offset, record.Offset)
+}
+
+func testOutOfRange(t *testing.T, client *Client) {
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, []byte("hello world"))
+		require.NoError(t, err)
+	}
+
+	_, err := client.Consume(ctx, 10)
+	var outOfRange *api.ErrOffsetOutOfRange
+	require.True(t, errors.As(err, &outOfRange))
+	require.Equal(t, uint64(10), outOfRange.Offset)
+	require.Equal(t, uint64(0), outOfRange.Lowest)
+	require.Equal(t, uint64(2), outOfRange.Highest)
+	require.Equal(t, uint64(3), outOfRange.Next)
+}
+
+// The log's errors reach the client with the codes they map to.
+func TestClientErrors(t *testing.T) {
+	ctx := context.Background()
+	produce := func(client *Client) error {
+		_, err := client.Produce(ctx, []byte("hello world"))
+		return err
+	}
+
+	t.Run("empty log is out of range", func(t *testing.T) {
+		clog, err := log.NewLogWithBackend(log.NewMemoryBackend(), log.Config{})
+		require.NoError(t, err)
+		defer clog.Close()
+		client, teardown := serve(t, clog)
+		defer teardown()
+
+		_, err = client.Consume(ctx, 0)
+		var outOfRange *api.ErrOffsetOutOfRange
+		require.True(t, errors.As(err, &outOfRange))
+		require.Equal(t, uint64(0), outOfRange.Lowest)
+		require.Equal(t, uint64(0), outOfRange.Next)
+	})
+
+	t.Run("closed log is unavailable", func(t *testing.T) {
+		clog, err := log.NewLogWithBackend(log.NewMemoryBackend(), log.Config{})
+		require.NoError(t, err)
+		client, teardown := serve(t, clog)
+		defer teardown()
+
+		require.NoError(t, clog.Close())
+		require.Equal(t, codes.Unavailable, status.Code(produce(client)))
+	})
+
+	t.Run("read-only log fails the precondition", func(t *testing.T) {
+		clog, err := log.NewLogWithBackend(log.NewMemoryBackend(), log.Config{ReadOnly: true})
+		require.NoError(t, err)
+		defer clog.Close()
+		client, teardown := serve(t, clog)
+		defer teardown()
+
+		require.Equal(t, codes.FailedPrecondition, status.Code(produce(client)))
+	})
+
+	t.Run("failed log is internal", func(t *testing.T) {
+		b := log.NewFaultBackend(log.NewMemoryBackend())
+		c := log.Config{}
+		c.Durability.Mode = log.DurabilityAlways
+		clog, err := log.NewLogWithBackend(b, c)
+		require.NoError(t, err)
+		defer clog.Close()
+		client, teardown := serve(t, clog)
+		defer teardown()
+
+		b.Inject(log.Fault{Op: log.OpSync, Err: syscall.EIO})
+		require.Equal(t, codes.Internal, status.Code(produce(client)))
+	})
+
+	t.Run("corrupt record is data loss", func(t *testing.T) {
+		b := log.NewFaultBackend(log.NewMemoryBackend())
+		clog, err := log.NewLogWithBackend(b, log.Config{})
+		require.NoError(t, err)
+		defer clog.Close()
+		client, teardown := serve(t, clog)
+		defer teardown()
+
+		require.NoError(t, produce(client))
+		b.Inject(log.Fault{Op: log.OpRead, Ext: ".store", Corrupt: true})
+		_, err = client.Consume(ctx, 0)
+		require.Equal(t, codes.DataLoss, status.Code(err))
+	})
+}
+
+func testStreams(t *testing.T, client *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	consume, err := client.ConsumeStream(ctx, 0)
+	require.NoError(t, err)
+
+	produce, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	for i := uint64(0); i < 3; i++ {
+		require.NoError(t, produce.Send([]byte("hello world")))
+		offset, err := produce.Recv()
+		require.NoError(t, err)
+		require.Equal(t, i, offset)
+	}
+	require.NoError(t, produce.CloseSend())
+
+	for i := uint64(0); i < 3; i++ {
+		record, err := consume.Recv()
+		require.NoError(t, err)
+		require.Equal(t, i, record.Offset)
+	}
+}
@@ -0,0 +1,215 @@
+package log
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/tysonmote/gommap"
+)
+
+/*
+	A log's segments are made of files: a store, an index and a time
+	index each. Where those files live is up to the log's backend. The
+	directory backend keeps them in a directory on disk, and the memory
+	backend keeps them in memory, for tests and for logs that don't
+	need to outlive the process.
+
+	Files are named by the backend, e.g. "16.store", and the segment
+	code only ever reads and writes at positions it tracks itself, so
+	a file doesn't need a read/write offset or an append mode.
+
+	Two logs writing to the same files corrupt them, so a log takes
+	its backend's lock when it's opened. The directory backend locks
+	a LOCK file in the directory with flock, which keeps out logs in
+	other processes too and is released by the operating system if
+	the process dies. Read-only logs never write, so they don't take
+	the lock and can be opened next to the log that's writing.
+*/
+
+// File is one of the files a log's segments are made of.
+// *os.File implements it.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	Name() string
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// Mapping is a file mapped into memory. Writes to its bytes
+// are writes to the file.
+type Mapping interface {
+	Bytes() []byte
+	// Sync commits the writes to the mapping to stable storage.
+	Sync() error
+	Unmap() error
+}
+
+// Backend stores the files a log's segments are made of.
+type Backend interface {
+	// List returns the names of the log's files.
+	List() ([]string, error)
+	// Open opens the named file for reading and writing,
+	// creating it if it doesn't exist.
+	Open(name string) (File, error)
+	// OpenReadOnly opens the named file for reading only. If it
+	// doesn't exist, the error satisfies os.IsNotExist.
+	OpenReadOnly(name string) (File, error)
+	// Map maps all of a file opened by the backend into memory.
+	// The file mustn't be resized while it's mapped.
+	Map(f File) (Mapping, error)
+	// MapReadOnly maps all of a file into memory for reading only.
+	// Someone else can still write to the file, and reading past
+	// its end if it shrinks is an error the process can't recover
+	// from.
+	MapReadOnly(f File) (Mapping, error)
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	// Sync commits the files created, removed and renamed
+	// to stable storage.
+	Sync() error
+	// RemoveAll removes all of the log's files.
+	RemoveAll() error
+	// Lock takes the backend's lock, so two logs can't write to
+	// the same files. It returns ErrLocked if the lock is already
+	// held. Closing the returned io.Closer releases the lock.
+	Lock() (io.Closer, error)
+}
+
+// NewDirBackend returns a backend that keeps the log's files in the
+// given directory, creating it when the first file is opened.
+func NewDirBackend(dir string) Backend {
+	return &dirBackend{dir: dir}
+}
+
+type dirBackend struct {
+	dir string
+}
+
+func (b *dirBackend) List() ([]string, error) {
+	files, err := ioutil.ReadDir(b.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	return names, nil
+}
+
+func (b *dirBackend) Open(name string) (File, error) {
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path.Join(b.dir, name), os.O_RDWR|os.O_CREATE, 0644)
+}
+
+func (b *dirBackend) OpenReadOnly(name string) (File, error) {
+	return os.Open(path.Join(b.dir, name))
+}
+
+func (b *dirBackend) Map(f File) (Mapping, error) {
+	return mmap(f, gommap.PROT_READ|gommap.PROT_WRITE)
+}
+
+func (b *dirBackend) MapReadOnly(f File) (Mapping, error) {
+	return mmap(f, gommap.PROT_READ)
+}
+
+// mmap maps the file into memory with the given protection.
+func mmap(f File, prot gommap.ProtFlags) (Mapping, error) {
+	m, err := gommap.Map(f.(*os.File).Fd(), prot, gommap.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return mmapping(m), nil
+}
+
+func (b *dirBackend) Remove(name string) error {
+	return os.Remove(path.Join(b.dir, name))
+}
+
+func (b *dirBackend) Rename(oldname, newname string) error {
+	return os.Rename(path.Join(b.dir, oldname), path.Join(b.dir, newname))
+}
+
+// Sync commits the directory's entries, such as files
+// created in or removed from it, to stable storage.
+func (b *dirBackend) Sync() error {
+	d, err := os.Open(b.dir)
+	if err != nil {
+		return err
+	}
+	if err = d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+
+	return d.Close()
+}
+
+func (b *dirBackend) RemoveAll() error {
+	return os.RemoveAll(b.dir)
+}
+
+// lockFile is the name of the file in the directory that's locked.
+const lockFile = "LOCK"
+
+// Lock locks the directory's lock file with flock, which the
+// operating system releases if the process dies.
+func (b *dirBackend) Lock() (io.Closer, error) {
+	f, err := b.Open(lockFile)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.(*os.File).Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		err = ErrLocked
+	}
+	if err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "lock", Path: f.Name(), Err: err}
+	}
+	return f, nil
+}
+
+// mmapping is a file memory-mapped by the operating system.
+type mmapping gommap.MMap
+
+func (m mmapping) Bytes() []byte {
+	return m
+}
+
+// Sync waits until the writes are on stable storage.
+func (m mmapping) Sync() error {
+	return gommap.MMap(m).Sync(gommap.MS_SYNC)
+}
+
+func (m mmapping) Unmap() error {
+	return gommap.MMap(m).UnsafeUnmap()
+}
+
+// fileInfo describes a file kept in memory.
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() os.FileMode  { return 0644 }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return false }
+func (fi fileInfo) Sys() interface{}   { return nil }
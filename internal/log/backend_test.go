@@ -0,0 +1,148 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackend(t *testing.T) {
+	for name, newBackend := range map[string]func(t *testing.T) Backend{
+		"dir": func(t *testing.T) Backend {
+			dir, err := ioutil.TempDir("", "backend-test")
+			require.NoError(t, err)
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			// The directory is created when the first file is opened.
+			return NewDirBackend(path.Join(dir, "log"))
+		},
+		"memory": func(t *testing.T) Backend {
+			return NewMemoryBackend()
+		},
+	} {
+		for scenario, fn := range map[string]func(t *testing.T, b Backend){
+			"files outlive being closed": testBackendReopen,
+			"rename and remove files":    testBackendRenameRemove,
+			"mapped writes reach file":   testBackendMap,
+			"log on the backend":         testBackendLog,
+			"lock is exclusive":          testBackendLock,
+		} {
+			t.Run(name+"/"+scenario, func(t *testing.T) {
+				fn(t, newBackend(t))
+			})
+		}
+	}
+}
+
+func testBackendReopen(t *testing.T, b Backend) {
+	names, err := b.List()
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	f, err := b.Open("0.store")
+	require.NoError(t, err)
+	_, err = f.WriteAt(write, 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	require.NoError(t, f.Close())
+
+	f, err = b.Open("0.store")
+	require.NoError(t, err)
+	defer f.Close()
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(len(write)), fi.Size())
+
+	read := make([]byte, len(write))
+	_, err = f.ReadAt(read, 0)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+
+	require.NoError(t, f.Truncate(5))
+	fi, err = f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(5), fi.Size())
+}
+
+func testBackendRenameRemove(t *testing.T, b Backend) {
+	for _, name := range []string{"0.store", "0.index"} {
+		f, err := b.Open(name)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+
+	require.NoError(t, b.Rename("0.store", "16.store"))
+	require.NoError(t, b.Remove("0.index"))
+	require.NoError(t, b.Sync())
+	names, err := b.List()
+	require.NoError(t, err)
+	require.Equal(t, []string{"16.store"}, names)
+
+	require.True(t, os.IsNotExist(b.Remove("0.index")))
+
+	require.NoError(t, b.RemoveAll())
+	names, err = b.List()
+	require.NoError(t, err)
+	require.Empty(t, names)
+}
+
+func testBackendMap(t *testing.T, b Backend) {
+	f, err := b.Open("0.index")
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, f.Truncate(int64(len(write))))
+
+	m, err := b.Map(f)
+	require.NoError(t, err)
+	copy(m.Bytes(), write)
+	require.NoError(t, m.Sync())
+	require.NoError(t, m.Unmap())
+
+	read := make([]byte, len(write))
+	_, err = f.ReadAt(read, 0)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+}
+
+func testBackendLog(t *testing.T, b Backend) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLogWithBackend(b, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 6)
+	require.NoError(t, log.Close())
+	require.Greater(t, len(log.segments), 1)
+
+	log, err = NewLogWithBackend(b, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Empty(t, log.Recovery())
+
+	for offset := uint64(0); offset < 6; offset++ {
+		read, err := log.Read(offset)
+		require.NoError(t, err)
+		require.Equal(t, offset, read.Offset)
+	}
+
+	require.NoError(t, log.Reset())
+	_, err = log.Read(0)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+	offset, err := log.Append(&api.Record{Value: write})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+}
+
+func testBackendLock(t *testing.T, b Backend) {
+	lock, err := b.Lock()
+	require.NoError(t, err)
+	_, err = b.Lock()
+	require.ErrorIs(t, err, ErrLocked)
+	require.NoError(t, lock.Close())
+
+	lock, err = b.Lock()
+	require.NoError(t, err)
+	require.NoError(t, lock.Close())
+}
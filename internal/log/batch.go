@@ -0,0 +1,176 @@
+package log
+
+import (
+	"errors"
+	"math"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+)
+
+/*
+	A batch of records has to become visible all at once or not at
+	all. Holding the write lock for the whole batch takes care of
+	readers, and a failed append rolls back the records before it.
+	Crashes need more than that, since the process can die with half
+	the batch on disk, possibly across a segment roll.
+
+	So before writing a batch the log creates a marker file named
+	after the batch's first offset, e.g. 42.batch, and syncs it. Once
+	every record in the batch is synced, the marker is removed. If
+	the log is opened and finds a marker, the batch never finished,
+	so everything from the marker's offset onwards is rolled back.
+	Batches are synced no matter the durability mode, since that's
+	what makes them all-or-nothing across a crash.
+*/
+
+const batchExt = ".batch"
+
+// AppendBatch appends the records with contiguous offsets so either
+// all of them become visible or none do, even if the service crashes
+// part way through. It returns the offset of the first record and
+// the number of records appended.
+func (l *Log) AppendBatch(records []*api.Record) (first uint64, n uint64, err error) {
+	start := l.metrics.appendSeconds.Start()
+	defer func() {
+		count(l.metrics.appends, l.metrics.appendErrors, n, err)
+		l.metrics.appendSeconds.ObserveSince(start)
+	}()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err = l.checkOpen(); err != nil {
+		return 0, 0, err
+	}
+	if err = l.checkWritable(); err != nil {
+		return 0, 0, err
+	}
+
+	first = l.activeSegment.nextOffset
+	if len(records) == 0 {
+		return first, 0, nil
+	}
+
+	// Once the marker's been created, a batch the log can't finish
+	// or roll back fails the log, leaving the marker so the batch is
+	// rolled back when the log is opened again.
+	marker := segmentFile(first, batchExt)
+	if err = l.createMarker(marker); err != nil {
+		return 0, 0, l.fail("append batch", err)
+	}
+
+	for _, record := range records {
+		if _, err = l.append(record); err != nil {
+			if errors.Is(err, ErrFailed) {
+				return 0, 0, err
+			}
+			if rerr := l.rollback(first); rerr != nil {
+				return 0, 0, l.fail("append batch", rerr)
+			}
+			if rerr := l.removeMarker(marker); rerr != nil {
+				return 0, 0, l.fail("append batch", rerr)
+			}
+			return 0, 0, err
+		}
+	}
+
+	for _, s := range l.segments {
+		if s.nextOffset > first {
+			if err = s.Sync(); err != nil {
+				return 0, 0, l.fail("sync", err)
+			}
+		}
+	}
+	l.unsyncedRecords = 0
+	l.unsyncedBytes = 0
+
+	if err = l.removeMarker(marker); err != nil {
+		return 0, 0, l.fail("append batch", err)
+	}
+	l.notify()
+
+	return first, uint64(len(records)), nil
+}
+
+// rollback drops the records from the given offset onwards,
+// removing any segments that only hold records after it. The
+// caller must hold the write lock.
+func (l *Log) rollback(offset uint64) error {
+	// The offsets are appended again.
+	l.cache.remove(offset, math.MaxUint64)
+
+	for len(l.segments) > 1 && l.activeSegment.baseOffset > offset {
+		remove := l.activeSegment.Remove
+		// A read-only log only stops reading the records.
+		if l.Config.ReadOnly {
+			remove = l.activeSegment.Close
+		}
+		if err := remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[:len(l.segments)-1]
+		l.activeSegment = l.segments[len(l.segments)-1]
+		// It's appended to again.
+		if err := l.activeSegment.store.unseal(); err != nil {
+			return err
+		}
+	}
+
+	return l.activeSegment.rollback(offset)
+}
+
+// rollbackBatch undoes a batch that didn't finish before the log was
+// last closed, given the offset its marker file was named after.
+func (l *Log) rollbackBatch(offset uint64) error {
+	var dropped uint64
+	for _, s := range l.segments {
+		if s.nextOffset > offset {
+			if s.baseOffset > offset {
+				dropped += s.nextOffset - s.baseOffset
+			} else {
+				dropped += s.nextOffset - offset
+			}
+		}
+	}
+
+	if err := l.rollback(offset); err != nil {
+		return err
+	}
+	l.activeSegment.recovered.Segment = l.activeSegment.baseOffset
+	l.activeSegment.recovered.RolledBack += dropped
+
+	// The log writing to a read-only log's files may still be
+	// appending the batch, and it's the one to remove the marker.
+	if l.Config.ReadOnly {
+		return nil
+	}
+	return l.removeMarker(segmentFile(offset, batchExt))
+}
+
+// createMarker creates the marker file and syncs it, along with the
+// backend's list of files, so it's on disk before any of the batch is.
+func (l *Log) createMarker(name string) error {
+	f, err := l.backend.Open(name)
+	if err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return l.backend.Sync()
+}
+
+// removeMarker removes the marker file and syncs the backend so
+// the batch isn't rolled back after it's reported as appended.
+func (l *Log) removeMarker(name string) error {
+	if err := l.backend.Remove(name); err != nil {
+		return err
+	}
+
+	return l.backend.Sync()
+}
@@ -0,0 +1,121 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendBatch(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"batch spans a segment roll":            testAppendBatchRoll,
+		"empty batch":                           testAppendBatchEmpty,
+		"rollback removes the batch's segments": testAppendBatchRollback,
+		"unfinished batch is rolled back":       testAppendBatchCrash,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "batch-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 64
+
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			fn(t, log)
+		})
+	}
+}
+
+func batchOf(n int) []*api.Record {
+	records := make([]*api.Record, n)
+	for i := range records {
+		records[i] = &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}
+	}
+	return records
+}
+
+func testAppendBatchRoll(t *testing.T, log *Log) {
+	appendRecords(t, log, 1)
+
+	first, n, err := log.AppendBatch(batchOf(5))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(5), n)
+	require.Greater(t, len(log.segments), 1)
+
+	for i := uint64(0); i < n; i++ {
+		read, err := log.Read(first + i)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(read.Value))
+	}
+
+	// The batch's marker is gone once it's appended.
+	_, err = os.Stat(path.Join(log.Dir, "1"+batchExt))
+	require.True(t, os.IsNotExist(err))
+	require.False(t, unsynced(log))
+}
+
+func testAppendBatchEmpty(t *testing.T, log *Log) {
+	appendRecords(t, log, 1)
+
+	first, n, err := log.AppendBatch(nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Zero(t, n)
+}
+
+func testAppendBatchRollback(t *testing.T, log *Log) {
+	appendRecords(t, log, 1)
+	_, _, err := log.AppendBatch(batchOf(5))
+	require.NoError(t, err)
+
+	log.mu.Lock()
+	err = log.rollback(1)
+	log.mu.Unlock()
+	require.NoError(t, err)
+
+	require.Len(t, log.segments, 1)
+	offset, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+
+	offset, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), offset)
+}
+
+// Put the marker back after a batch, as if the
+// service crashed before the batch finished.
+func testAppendBatchCrash(t *testing.T, log *Log) {
+	appendRecords(t, log, 1)
+	first, n, err := log.AppendBatch(batchOf(5))
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	require.NoError(t, log.createMarker(segmentFile(first, batchExt)))
+
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+
+	require.Equal(t, []RecoveryReport{{RolledBack: n}}, log.Recovery())
+	offset, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+	_, err = log.Read(first)
+	require.Error(t, err)
+
+	files, err := ioutil.ReadDir(log.Dir)
+	require.NoError(t, err)
+	for _, file := range files {
+		require.NotEqual(t, batchExt, path.Ext(file.Name()))
+	}
+}
@@ -0,0 +1,159 @@
+package log
+
+import (
+	"container/list"
+	"sync"
+)
+
+/*
+	The record cache keeps the encoded bytes of recently read records
+	by offset, so consumers re-reading the same offsets skip the index
+	lookup and the store. Reads only hold the log's read lock, so the
+	cache has a lock of its own.
+
+	Offsets are reused once records are dropped, e.g. when a batch is
+	rolled back or the log is reset, and compaction removes records
+	that could otherwise still be read from the cache. So whatever
+	drops or removes records removes them from the cache too.
+*/
+
+// CacheStats describes the log's record cache.
+type CacheStats struct {
+	// Hits and Misses count the reads that found
+	// their record in the cache and the ones that didn't.
+	Hits   uint64
+	Misses uint64
+	// Records is the number of records in the cache, and
+	// Bytes the size of their encoded bytes.
+	Records int
+	Bytes   uint64
+}
+
+// recordCache is a least recently used cache of encoded records,
+// bounded by their size in bytes. A nil cache caches nothing.
+type recordCache struct {
+	mu       sync.Mutex
+	maxBytes uint64
+	bytes    uint64
+	// Most recently used first.
+	lru     *list.List
+	records map[uint64]*list.Element
+	hits    uint64
+	misses  uint64
+}
+
+type cachedRecord struct {
+	offset uint64
+	p      []byte
+}
+
+// newRecordCache returns a cache holding up to maxBytes of
+// records, or nil if maxBytes is zero.
+func newRecordCache(maxBytes uint64) *recordCache {
+	if maxBytes == 0 {
+		return nil
+	}
+	return &recordCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		records:  make(map[uint64]*list.Element),
+	}
+}
+
+// get returns the bytes of the record with the given offset,
+// which mustn't be modified, or false if it isn't cached.
+func (c *recordCache) get(offset uint64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.records[offset]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedRecord).p, true
+}
+
+// add caches a copy of the record's bytes, which can be a view into
+// a mapped store, evicting the least recently used records to make
+// room. Records bigger than the whole cache aren't cached.
+func (c *recordCache) add(offset uint64, p []byte) {
+	if c == nil || uint64(len(p)) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.records[offset]; ok {
+		return
+	}
+	record := &cachedRecord{offset: offset, p: append([]byte(nil), p...)}
+	c.records[offset] = c.lru.PushFront(record)
+	c.bytes += uint64(len(p))
+
+	for c.bytes > c.maxBytes {
+		c.evict(c.lru.Back())
+	}
+}
+
+// remove removes the records with offsets from from up
+// to but not including to.
+func (c *recordCache) remove(from, to uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for offset, e := range c.records {
+		if from <= offset && offset < to {
+			c.evict(e)
+		}
+	}
+}
+
+// clear removes every record. The counters are kept.
+func (c *recordCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	c.records = make(map[uint64]*list.Element)
+	c.bytes = 0
+}
+
+// evict removes the cached record. The caller must hold the lock.
+func (c *recordCache) evict(e *list.Element) {
+	record := c.lru.Remove(e).(*cachedRecord)
+	delete(c.records, record.offset)
+	c.bytes -= uint64(len(record.p))
+}
+
+func (c *recordCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Records: c.lru.Len(),
+		Bytes:   c.bytes,
+	}
+}
+
+// CacheStats reports how well the log's record cache is doing.
+// It's all zeros if the log doesn't have one.
+func (l *Log) CacheStats() CacheStats {
+	return l.cache.stats()
+}
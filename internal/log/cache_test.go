@@ -0,0 +1,163 @@
+package log
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"read again is a hit":                 testCacheHit,
+		"truncate removes records":            testCacheTruncate,
+		"reset removes records":               testCacheReset,
+		"rolled back records are removed":     testCacheRollback,
+		"compacted records are removed":       testCacheCompact,
+		"raw and decoded reads share records": testCacheRaw,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			// Three records to a segment.
+			c := Config{}
+			c.Segment.MaxIndexBytes = entryWidth * 3
+			c.Cache.MaxBytes = 1024
+
+			log, err := NewLogWithBackend(NewMemoryBackend(), c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			fn(t, log)
+		})
+	}
+}
+
+// readValue reads the record at the offset and returns its value.
+func readValue(t *testing.T, log *Log, offset uint64) string {
+	t.Helper()
+
+	read, err := log.Read(offset)
+	require.NoError(t, err)
+	return string(read.Value)
+}
+
+func testCacheHit(t *testing.T, log *Log) {
+	appendKeyed(t, log, "a", "b")
+
+	require.Equal(t, "a", readValue(t, log, 0))
+	require.Equal(t, "a", readValue(t, log, 0))
+	require.Equal(t, "b", readValue(t, log, 1))
+
+	stats := log.CacheStats()
+	require.Equal(t, uint64(1), stats.Hits)
+	require.Equal(t, uint64(2), stats.Misses)
+	require.Equal(t, 2, stats.Records)
+	require.NotZero(t, stats.Bytes)
+}
+
+func testCacheTruncate(t *testing.T, log *Log) {
+	appendKeyed(t, log, "a", "b", "c", "d")
+	for offset := uint64(0); offset < 4; offset++ {
+		readValue(t, log, offset)
+	}
+
+	require.NoError(t, log.Truncate(2))
+	require.Equal(t, 1, log.CacheStats().Records)
+	_, err := log.Read(0)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+	require.Equal(t, "d", readValue(t, log, 3))
+}
+
+func testCacheReset(t *testing.T, log *Log) {
+	appendKeyed(t, log, "a")
+	readValue(t, log, 0)
+
+	require.NoError(t, log.Reset())
+	require.Zero(t, log.CacheStats().Records)
+	appendKeyed(t, log, "b")
+	require.Equal(t, "b", readValue(t, log, 0))
+}
+
+// The offsets of records rolled back are given to the
+// records appended after them.
+func testCacheRollback(t *testing.T, log *Log) {
+	appendKeyed(t, log, "a", "b", "c", "d")
+	for offset := uint64(0); offset < 4; offset++ {
+		readValue(t, log, offset)
+	}
+
+	log.mu.Lock()
+	require.NoError(t, log.rollback(2))
+	log.mu.Unlock()
+
+	appendKeyed(t, log, "e", "f")
+	require.Equal(t, []string{"a", "b", "e", "f"}, []string{
+		readValue(t, log, 0),
+		readValue(t, log, 1),
+		readValue(t, log, 2),
+		readValue(t, log, 3),
+	})
+}
+
+func testCacheCompact(t *testing.T, log *Log) {
+	// Segment 0 is sealed and 3 is active.
+	appendKeyed(t, log, "a", "b", "c", "a")
+	readValue(t, log, 0)
+
+	_, err := log.Compact()
+	require.NoError(t, err)
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), read.Offset)
+}
+
+func testCacheRaw(t *testing.T, log *Log) {
+	appendKeyed(t, log, "a")
+
+	var size int
+	offset, err := log.ReadRawFunc(0, func(p []byte) error {
+		size = len(p)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+	require.Equal(t, "a", readValue(t, log, 0))
+	require.Equal(t, uint64(1), log.CacheStats().Hits)
+	require.Equal(t, uint64(size), log.CacheStats().Bytes)
+}
+
+func TestRecordCacheEvicts(t *testing.T) {
+	c := newRecordCache(8)
+	record := []byte("four")
+
+	c.add(0, record)
+	c.add(1, record)
+	// Reading 0 makes 1 the least recently used.
+	_, ok := c.get(0)
+	require.True(t, ok)
+	c.add(2, record)
+
+	_, ok = c.get(1)
+	require.False(t, ok)
+	for _, offset := range []uint64{0, 2} {
+		p, ok := c.get(offset)
+		require.True(t, ok)
+		require.Equal(t, record, p)
+	}
+
+	// The cache keeps a copy of what it's given.
+	record[0] = 'F'
+	p, _ := c.get(2)
+	require.Equal(t, []byte("four"), p)
+
+	// Records bigger than the cache aren't cached.
+	c.add(3, []byte("too big to cache"))
+	_, ok = c.get(3)
+	require.False(t, ok)
+	require.Equal(t, CacheStats{Hits: 4, Misses: 2, Records: 2, Bytes: 8}, c.stats())
+
+	// A log without a cache has no stats.
+	var none *recordCache
+	none.add(0, record)
+	_, ok = none.get(0)
+	require.False(t, ok)
+	require.Equal(t, CacheStats{}, none.stats())
+}
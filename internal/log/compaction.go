@@ -0,0 +1,358 @@
+package log
+
+import (
+	"time"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+	Compaction is for logs where only the newest record for each key
+	matters, like a changelog of a table. It rewrites sealed segments
+	without the records that a newer record with the same key
+	replaced. The kept records keep their offsets, so consumers can
+	go on using the offsets they have, and the log ends up with gaps
+	in its offsets that reads and iterators skip over. A segment can
+	lose the records at its end, or all of them, so the rewritten
+	store's header keeps the segment's next offset for when the log
+	is opened again.
+
+	A record with a key and an empty value is a tombstone, meaning
+	the key was deleted. Once a tombstone is the newest record for
+	its key, it's kept for the tombstone grace period so consumers
+	get to see the key was deleted, and then it's removed too.
+
+	Records without a key can't be replaced, so they're always kept.
+	The active segment is never compacted, though its records still
+	replace older records in sealed segments.
+
+	A segment is rewritten into temporary files that are then renamed
+	over the segment's files. If the service stops before it's done,
+	the temporary files are removed when the log is opened again and
+	the segment is left as it was, or its index is rebuilt if only
+	some of the files were renamed.
+*/
+
+// compactingExt is added to the names of the files a segment is
+// being rewritten into.
+const compactingExt = ".compacting"
+
+// CompactionReport describes what a compaction removed.
+type CompactionReport struct {
+	// Segments is the number of segments rewritten.
+	Segments int
+	// Records is the number of records removed, and Tombstones
+	// how many of those were tombstones.
+	Records    uint64
+	Tombstones uint64
+	// Bytes is how many fewer bytes the segments' stores take up.
+	Bytes uint64
+}
+
+func (r *CompactionReport) add(o CompactionReport) {
+	r.Segments += o.Segments
+	r.Records += o.Records
+	r.Tombstones += o.Tombstones
+	r.Bytes += o.Bytes
+}
+
+// Compact rewrites the log's sealed segments to keep only the newest
+// record for each key. It's run in the background when compaction is
+// enabled in the config and can be called any time.
+func (l *Log) Compact() (CompactionReport, error) {
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
+
+	return l.compact(time.Now())
+}
+
+// compactInBackground is run in the background with compaction
+// enabled. A segment that fails to be compacted is tried again
+// next time.
+func (l *Log) compactInBackground() {
+	l.Compact()
+}
+
+/*
+	Sealed segments aren't written to, and everything that closes or
+	removes segments takes the compacting lock first, so while it's
+	held the sealed segments can be read without the log's lock.
+	Compaction finds the newest records and rewrites the segments that
+	way, so appends and reads go on while it runs, and only takes the
+	write lock to swap each rewritten segment in.
+*/
+
+// compact compacts the sealed segments as of now. The caller must
+// hold the compacting lock, and not the log's lock.
+func (l *Log) compact(now time.Time) (CompactionReport, error) {
+	var report CompactionReport
+
+	// The last segment is the active one.
+	var sealed []*segment
+	l.mu.RLock()
+	err := l.checkOpen()
+	if err == nil {
+		err = l.checkWritable()
+	}
+	if err == nil {
+		sealed = append(sealed, l.segments[:len(l.segments)-1]...)
+	}
+	l.mu.RUnlock()
+	if err != nil {
+		return report, err
+	}
+
+	latest := make(map[string]uint64)
+	newest := func(record *api.Record, _ uint64) error {
+		if len(record.Key) > 0 {
+			latest[string(record.Key)] = record.Offset
+		}
+		return nil
+	}
+	for _, s := range sealed {
+		if err := s.walk(newest); err != nil {
+			return report, err
+		}
+	}
+	// The active segment, and any rolled since, are still
+	// appended to, so they're read under the lock.
+	l.mu.RLock()
+	for _, s := range l.segments[len(sealed):] {
+		if err = s.walk(newest); err != nil {
+			break
+		}
+	}
+	l.mu.RUnlock()
+	if err != nil {
+		return report, err
+	}
+
+	for i, s := range sealed {
+		r, err := l.compactSegment(s, latest, now)
+		if err != nil {
+			return report, err
+		}
+		// Segments with nothing to remove are left as they are.
+		if r.Records == 0 {
+			continue
+		}
+		if err = l.swapCompacted(i, s); err != nil {
+			return report, err
+		}
+		report.add(r)
+	}
+
+	return report, nil
+}
+
+// keep reports whether compaction keeps the record, given the
+// offset of the newest record for each key.
+func (l *Log) keep(record *api.Record, latest map[string]uint64, now time.Time) bool {
+	if len(record.Key) == 0 {
+		return true
+	}
+	if latest[string(record.Key)] != record.Offset {
+		return false
+	}
+	if len(record.Value) == 0 {
+		grace := l.Config.Compaction.TombstoneGrace
+		return now.Sub(record.AppendTime.AsTime()) < grace
+	}
+	return true
+}
+
+// compactSegment rewrites the sealed segment into temporary files
+// without the records compaction removes. It writes nothing if
+// there's nothing to remove, which the report's zero Records says.
+func (l *Log) compactSegment(
+	s *segment,
+	latest map[string]uint64,
+	now time.Time,
+) (CompactionReport, error) {
+	report := CompactionReport{Segments: 1}
+
+	type kept struct {
+		offset   uint64
+		appended int64
+		position uint64
+	}
+	var keep []kept
+	if err := s.walk(func(record *api.Record, position uint64) error {
+		if l.keep(record, latest, now) {
+			keep = append(keep, kept{
+				offset:   record.Offset,
+				appended: record.AppendTime.AsTime().UnixNano(),
+				position: position,
+			})
+			return nil
+		}
+		report.Records++
+		if len(record.Value) == 0 {
+			report.Tombstones++
+		}
+		return nil
+	}); err != nil {
+		return report, err
+	}
+	if report.Records == 0 {
+		return report, nil
+	}
+
+	names := compactedFiles(s.baseOffset)
+	files := make([]File, len(names))
+	for i, name := range names {
+		f, err := l.backend.Open(name + compactingExt)
+		if err == nil {
+			// Left over from a compaction that failed.
+			err = f.Truncate(0)
+		}
+		if err != nil {
+			return report, l.removeCompacting(names, err)
+		}
+		defer f.Close()
+		files[i] = f
+	}
+
+	st, err := newStore(files[0])
+	if err != nil {
+		return report, l.removeCompacting(names, err)
+	}
+	// The rewritten segment can be left without the records at
+	// its end, so its header keeps where it ended.
+	st.compactedNext = s.nextOffset
+	if err = st.writeHeader(); err != nil {
+		return report, l.removeCompacting(names, err)
+	}
+	ti := &timeIndex{file: files[2]}
+	idx := make([]byte, 0, uint64(len(keep))*entryWidth)
+	entry := make([]byte, entryWidth)
+	var timeIndexed uint64
+	for _, k := range keep {
+		p, err := s.store.Read(k.position)
+		if err != nil {
+			return report, l.removeCompacting(names, err)
+		}
+		_, position, err := st.Append(p)
+		if err != nil {
+			return report, l.removeCompacting(names, err)
+		}
+
+		rel := uint32(k.offset - s.baseOffset)
+		enc.PutUint32(entry[:offsetWidth], rel)
+		enc.PutUint64(entry[offsetWidth:], position)
+		idx = append(idx, entry...)
+
+		if len(ti.entries) == 0 || position >= timeIndexed+l.Config.Segment.TimeIndexBytes {
+			if err = ti.Write(k.appended, rel); err != nil {
+				return report, l.removeCompacting(names, err)
+			}
+			timeIndexed = position
+		}
+	}
+	if _, err = files[1].WriteAt(idx, 0); err != nil {
+		return report, l.removeCompacting(names, err)
+	}
+	if err = st.Sync(); err != nil {
+		return report, l.removeCompacting(names, err)
+	}
+	for _, f := range files[1:] {
+		if err = f.Sync(); err != nil {
+			return report, l.removeCompacting(names, err)
+		}
+	}
+	// Rewriting a version 1 store adds checksums to its
+	// records, so it can end up bigger than it was.
+	if st.size < s.store.size {
+		report.Bytes = s.store.size - st.size
+	}
+
+	return report, nil
+}
+
+// swapCompacted closes the sealed segment s, the ith of the log's
+// segments, and opens the files it was rewritten into in its place.
+// The compacting lock keeps s where it was in the segments.
+func (l *Log) swapCompacted(i int, s *segment) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	names := compactedFiles(s.baseOffset)
+	if err := l.checkOpen(); err != nil {
+		return l.removeCompacting(names, err)
+	}
+	if err := l.checkWritable(); err != nil {
+		return l.removeCompacting(names, err)
+	}
+
+	// The store goes first, so if the service stops part of the
+	// way through, the index disagrees with it and is rebuilt.
+	// Once the segment's closed, the log can't go on without
+	// it, so failing after that fails the log.
+	if err := s.Close(); err != nil {
+		return l.fail("compact", l.removeCompacting(names, err))
+	}
+	for _, name := range names {
+		if err := l.backend.Rename(name+compactingExt, name); err != nil {
+			return l.fail("compact", err)
+		}
+	}
+	if err := l.backend.Sync(); err != nil {
+		return l.fail("compact", err)
+	}
+
+	compacted, err := newSegment(l.backend, s.baseOffset, l.Config, l.metrics)
+	if err != nil {
+		return l.fail("compact", err)
+	}
+	if err = compacted.seal(); err != nil {
+		return l.fail("compact", err)
+	}
+	compacted.nextOffset = s.nextOffset
+	compacted.firstAppended = s.firstAppended
+	compacted.lastAppended = s.lastAppended
+
+	l.segments[i] = compacted
+	l.cache.remove(compacted.baseOffset, compacted.nextOffset)
+	return nil
+}
+
+// compactedFiles returns the names of the segment's files, in the
+// order they're renamed when it's compacted.
+func compactedFiles(baseOffset uint64) []string {
+	return []string{
+		segmentFile(baseOffset, storeExt),
+		segmentFile(baseOffset, indexExt),
+		segmentFile(baseOffset, timeIndexExt),
+	}
+}
+
+// removeCompacting removes the files a segment was being rewritten
+// into after the rewrite failed with the given error, which it
+// returns.
+func (l *Log) removeCompacting(names []string, cause error) error {
+	for _, name := range names {
+		l.backend.Remove(name + compactingExt)
+	}
+	return cause
+}
+
+// walk calls fn with each of the segment's records in order,
+// along with its position in the store.
+func (s *segment) walk(fn func(record *api.Record, position uint64) error) error {
+	for position := s.store.start(); position < s.store.size; {
+		p, err := s.store.Read(position)
+		if err != nil {
+			return err
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(p, record); err != nil {
+			return err
+		}
+		if err = fn(record, position); err != nil {
+			return err
+		}
+		position = s.store.nextPosition(position, p)
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompaction(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string, c Config){
+		"newest record per key is kept":            testCompactNewest,
+		"tombstones are kept for the grace":        testCompactTombstones,
+		"records without keys are kept":            testCompactKeyless,
+		"compacted log reopens with its gaps":      testCompactReopen,
+		"emptied segment reopens with its end":     testCompactEmptied,
+		"iterator skips records compacted away":    testCompactIterator,
+		"unfinished compaction is cleaned up":      testCompactUnfinished,
+		"compaction runs in the background":        testCompactBackground,
+		"appends and reads go on while compacting": testCompactConcurrent,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "compaction-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// Three records to a segment.
+			c := Config{}
+			c.Segment.MaxIndexBytes = entryWidth * 3
+
+			fn(t, dir, c)
+		})
+	}
+}
+
+// appendKeyed appends a record for each key, with a value
+// of the key and its offset, or a tombstone if it's "-key".
+func appendKeyed(t *testing.T, log *Log, keys ...string) {
+	t.Helper()
+
+	for _, key := range keys {
+		record := &api.Record{Key: []byte(key), Value: []byte(key)}
+		if key[0] == '-' {
+			record = &api.Record{Key: []byte(key[1:])}
+		}
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+}
+
+// readOffsets reads the log with an iterator from the
+// given offset and returns the offsets of the records.
+func readOffsets(t *testing.T, log *Log, from uint64) []uint64 {
+	t.Helper()
+
+	var offsets []uint64
+	it := log.Iterator(from)
+	for it.Next() {
+		offsets = append(offsets, it.Record().Offset)
+	}
+	require.NoError(t, it.Err())
+	return offsets
+}
+
+func compactAt(t *testing.T, log *Log, now time.Time) CompactionReport {
+	t.Helper()
+
+	log.compacting.Lock()
+	defer log.compacting.Unlock()
+	report, err := log.compact(now)
+	require.NoError(t, err)
+	return report
+}
+
+func testCompactNewest(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// Segments 0 and 3 are sealed and 6 is active.
+	appendKeyed(t, log, "a", "b", "a", "c", "b", "a", "c")
+
+	report, err := log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Segments)
+	require.Equal(t, uint64(4), report.Records)
+	require.Zero(t, report.Tombstones)
+	require.NotZero(t, report.Bytes)
+
+	// The first segment is left empty, so reading its
+	// offsets reads the first record after them.
+	for _, off := range []uint64{0, 1, 2, 3} {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), read.Offset)
+		require.Equal(t, []byte("b"), read.Key)
+	}
+	read, err := log.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), read.Offset)
+	require.Equal(t, []byte("a"), read.Key)
+
+	require.Equal(t, []uint64{4, 5, 6}, readOffsets(t, log, 0))
+
+	// Compacting again has nothing left to remove.
+	report, err = log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, CompactionReport{}, report)
+
+	// The log keeps its offsets and appends carry on.
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	off, err := log.Append(&api.Record{Key: []byte("a"), Value: []byte("a")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+}
+
+func testCompactTombstones(t *testing.T, dir string, c Config) {
+	c.Compaction.TombstoneGrace = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	appendKeyed(t, log, "a", "-a", "b", "c")
+
+	report := compactAt(t, log, time.Now())
+	require.Equal(t, uint64(1), report.Records)
+	require.Zero(t, report.Tombstones)
+	require.Equal(t, []uint64{1, 2, 3}, readOffsets(t, log, 0))
+
+	report = compactAt(t, log, time.Now().Add(2*time.Hour))
+	require.Equal(t, uint64(1), report.Records)
+	require.Equal(t, uint64(1), report.Tombstones)
+	require.Equal(t, []uint64{2, 3}, readOffsets(t, log, 0))
+}
+
+func testCompactKeyless(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	appendRecords(t, log, 4)
+	report, err := log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, CompactionReport{}, report)
+	require.Equal(t, []uint64{0, 1, 2, 3}, readOffsets(t, log, 0))
+}
+
+func testCompactReopen(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// The end of the first segment is compacted away.
+	appendKeyed(t, log, "a", "b", "c", "b", "c", "d", "e")
+	_, err = log.Compact()
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Empty(t, log.Recovery())
+	// The offsets compacted away at the end of the first
+	// segment aren't missing from the log.
+	require.Empty(t, log.Discovery())
+	require.Equal(t, uint64(3), log.segments[0].nextOffset)
+
+	require.Equal(t, []uint64{0, 3, 4, 5, 6}, readOffsets(t, log, 0))
+	read, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), read.Offset)
+
+	// A rebuilt index keeps the gaps too.
+	_, err = log.RebuildIndex(0)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 3, 4, 5, 6}, readOffsets(t, log, 0))
+}
+
+func testCompactEmptied(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// Every record in the first segment is replaced.
+	appendKeyed(t, log, "a", "b", "c", "a", "b", "c", "d")
+	report, err := log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), report.Records)
+	require.NoError(t, log.Close())
+
+	// The rewritten store has no records, only
+	// the header that says where the segment ended.
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Empty(t, log.Recovery())
+	require.Empty(t, log.Discovery())
+	s := log.segments[0]
+	require.Equal(t, uint64(storeHeaderWidth), s.store.size)
+	require.Equal(t, uint64(3), s.store.compactedNext)
+	require.Equal(t, uint64(3), s.nextOffset)
+
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), read.Offset)
+	require.Equal(t, []uint64{3, 4, 5, 6}, readOffsets(t, log, 0))
+
+	// Compacting again leaves it alone.
+	report, err = log.Compact()
+	require.NoError(t, err)
+	require.Equal(t, CompactionReport{}, report)
+}
+
+func testCompactIterator(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	appendKeyed(t, log, "a", "b", "c", "a", "b", "c", "d")
+
+	it := log.Iterator(0)
+	require.True(t, it.Next())
+	require.Equal(t, uint64(0), it.Record().Offset)
+
+	// The segment the iterator is reading is replaced.
+	_, err = log.Compact()
+	require.NoError(t, err)
+
+	var offsets []uint64
+	for it.Next() {
+		offsets = append(offsets, it.Record().Offset)
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []uint64{3, 4, 5, 6}, offsets)
+}
+
+func testCompactUnfinished(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendKeyed(t, log, "a", "b", "c", "a")
+	require.NoError(t, log.Close())
+
+	name := log.segments[0].store.Name() + compactingExt
+	require.NoError(t, ioutil.WriteFile(name, []byte("partial"), 0644))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = os.Stat(name)
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, []uint64{0, 1, 2, 3}, readOffsets(t, log, 0))
+}
+
+func testCompactBackground(t *testing.T, dir string, c Config) {
+	c.Compaction.Enabled = true
+	c.Compaction.Interval = time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	appendKeyed(t, log, "a", "b", "c", "a")
+
+	require.Eventually(t, func() bool {
+		read, err := log.Read(0)
+		return err == nil && read.Offset == 1
+	}, time.Second, time.Millisecond)
+}
+
+// Compact over and over while records are appended and read, so
+// the race detector sees compaction read sealed segments without
+// the log's lock.
+func testCompactConcurrent(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	done := make(chan struct{})
+	compacted := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				compacted <- nil
+				return
+			default:
+			}
+			if _, err := log.Compact(); err != nil {
+				compacted <- err
+				return
+			}
+		}
+	}()
+
+	keys := []string{"a", "b", "c", "d"}
+	for i := 0; i < 60; i++ {
+		key := keys[i%len(keys)]
+		off, err := log.Append(&api.Record{Key: []byte(key), Value: []byte(key)})
+		require.NoError(t, err)
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(key), read.Key)
+	}
+	close(done)
+	require.NoError(t, <-compacted)
+
+	_, err = log.Compact()
+	require.NoError(t, err)
+	// Only the newest record for each key is left.
+	require.Equal(t, []uint64{56, 57, 58, 59}, readOffsets(t, log, 0))
+}
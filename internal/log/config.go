@@ -1,12 +1,125 @@
 package log
 
+import (
+	"time"
+
+	"github.com/jimxshaw/loglib/internal/metrics"
+)
+
 // Config provides configuration of a log,
 // such as the max size of a segment's
 // store and index.
 type Config struct {
+	// ReadOnly opens the log for reading only, as OpenReadOnly
+	// does. Writes return ErrReadOnly.
+	ReadOnly bool
+
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// MaxAge rolls to a new segment once the active segment's
+		// first record is older than this, so retention can reclaim
+		// segments that fill up slowly. It's checked every tenth
+		// of MaxAge, so a segment rolls at most that late. Zero
+		// turns it off.
+		MaxAge time.Duration
+		// TimeIndexBytes is how many bytes of records go between
+		// entries in a segment's time index. Fewer bytes make
+		// lookups by time faster and the time index bigger.
+		TimeIndexBytes uint64
+		// MapSealed maps the stores of sealed segments into memory,
+		// so records are read from the mapping without a syscall or
+		// a copy. ReadRawFunc then passes on views into it.
+		MapSealed bool
+	}
+	// Durability sets when appended records are committed to stable
+	// storage, trading append latency for how much a crash can lose.
+	Durability struct {
+		Mode DurabilityMode
+		// With DurabilityEvery, sync once this many records or
+		// bytes have been appended since the last sync, whichever
+		// comes first. Zero turns off that limit.
+		EveryRecords uint64
+		EveryBytes   uint64
+		// With DurabilityInterval, sync this often.
+		Interval time.Duration
+		// GroupCommit gathers appends from concurrent callers and
+		// writes them together, so they share a single sync.
+		GroupCommit struct {
+			Enabled bool
+			// Window is how long to wait for more appends after the
+			// first one arrives. With no window, a batch is whatever
+			// queued up while the last batch was being written.
+			Window time.Duration
+			// MaxRecords caps the size of a batch. Zero means no cap.
+			MaxRecords int
+		}
+	}
+	// Retention sets how much of the log to keep. A background
+	// cleaner removes the oldest segments once any limit is passed.
+	// Zero turns off that limit. The active segment is never removed.
+	Retention struct {
+		// MaxAge removes segments whose newest record is older than this.
+		MaxAge time.Duration
+		// MaxBytes removes the oldest segments while the log's
+		// segments take up more than this many bytes.
+		MaxBytes uint64
+		// MaxSegments removes the oldest segments while the log
+		// has more than this many.
+		MaxSegments int
+		// CheckInterval is how often the cleaner checks the limits.
+		// Defaults to a minute.
+		CheckInterval time.Duration
+		// OnDelete, if set, is called for each segment the cleaner
+		// removes. It's called without the log's lock held.
+		OnDelete func(DeletedSegment)
+	}
+	// Cache keeps recently read records in memory, for consumers
+	// that read the same offsets again.
+	Cache struct {
+		// MaxBytes is how many bytes of records to keep. Zero
+		// turns the cache off.
+		MaxBytes uint64
+	}
+	// Metrics reports the log's counters, gauges and latencies to
+	// a registry, which can serve them for Prometheus to scrape.
+	Metrics struct {
+		// Registry is where the metrics go. Nil turns them off.
+		Registry *metrics.Registry
+		// Labels tell this log's metrics apart from the metrics of
+		// other logs in the same registry, e.g. {"topic": "orders"}.
+		Labels metrics.Labels
+	}
+	// Compaction keeps only the newest record for each key in
+	// sealed segments, for logs where older values don't matter.
+	Compaction struct {
+		// Enabled compacts the log in the background.
+		Enabled bool
+		// Interval is how often to compact. Defaults to a minute.
+		Interval time.Duration
+		// TombstoneGrace is how long to keep a tombstone, a record
+		// with a key and an empty value, once it's the newest record
+		// for its key, so consumers see that the key was deleted.
+		TombstoneGrace time.Duration
 	}
 }
+
+// DurabilityMode picks when the log syncs its files.
+type DurabilityMode int
+
+const (
+	// DurabilityOS leaves it to the operating system to write
+	// records to disk whenever it sees fit. It's the fastest mode
+	// and a crash of the machine loses whatever wasn't written yet.
+	DurabilityOS DurabilityMode = iota
+	// DurabilityAlways syncs after every append, so a record is
+	// on stable storage by the time Append returns.
+	DurabilityAlways
+	// DurabilityEvery syncs after a set number of records or
+	// bytes, bounding how much a crash can lose.
+	DurabilityEvery
+	// DurabilityInterval syncs in the background on a timer,
+	// bounding how long a record can go without being synced.
+	DurabilityInterval
+)
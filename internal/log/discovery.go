@@ -0,0 +1,145 @@
+package log
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	When the log is opened it works out its segments from the names of
+	the files in its directory. A file belongs to the log only if its
+	name is exactly a base offset followed by one of the log's
+	extensions, the way segmentFile names it. Anything else, such as
+	the LOCK file, a .DS_Store or a backup an operator left there, is
+	ignored and left alone.
+
+	Files are grouped by base offset, and each group with a store is a
+	segment. The store is the source of truth, so a segment with no
+	index has its index rebuilt, but an index or time index with no
+	store has no records to go with it. Those orphans are reported and
+	left where they are. Offsets missing between one segment and the
+	next are reported too. Both can mean files were lost, though
+	compaction also leaves offsets missing at the end of a segment, so
+	a gap in a compacted log can be expected.
+*/
+
+// discovery is what the log found in its list of files.
+type discovery struct {
+	// Base offsets of the segments, oldest first.
+	segments []uint64
+	// Offsets of the batches that didn't finish, oldest first.
+	batches []uint64
+	// Files left by a compaction that didn't finish.
+	compacting []string
+	orphans    []*OrphanError
+}
+
+// discover groups the named files by base offset and extension.
+func discover(names []string) discovery {
+	var d discovery
+	groups := make(map[uint64][]string)
+	for _, name := range names {
+		if strings.HasSuffix(name, compactingExt) {
+			if _, ext, ok := parseSegmentFile(strings.TrimSuffix(name, compactingExt)); ok && ext != batchExt {
+				d.compacting = append(d.compacting, name)
+			}
+			continue
+		}
+
+		baseOffset, ext, ok := parseSegmentFile(name)
+		if !ok {
+			continue
+		}
+		if ext == batchExt {
+			// Batch markers aren't segments, they mean
+			// a batch of appends didn't finish.
+			d.batches = append(d.batches, baseOffset)
+			continue
+		}
+		groups[baseOffset] = append(groups[baseOffset], ext)
+	}
+
+	for baseOffset, exts := range groups {
+		if hasExt(exts, storeExt) {
+			d.segments = append(d.segments, baseOffset)
+			continue
+		}
+		orphan := &OrphanError{Segment: baseOffset}
+		for _, ext := range exts {
+			orphan.Files = append(orphan.Files, segmentFile(baseOffset, ext))
+		}
+		sort.Strings(orphan.Files)
+		d.orphans = append(d.orphans, orphan)
+	}
+
+	sortOffsets(d.segments)
+	sortOffsets(d.batches)
+	sort.Slice(d.orphans, func(i, j int) bool {
+		return d.orphans[i].Segment < d.orphans[j].Segment
+	})
+	return d
+}
+
+// parseSegmentFile returns the base offset and extension of a file
+// named by segmentFile, or false if the log didn't name it.
+func parseSegmentFile(name string) (uint64, string, bool) {
+	ext := path.Ext(name)
+	switch ext {
+	case storeExt, indexExt, timeIndexExt, batchExt:
+	default:
+		return 0, "", false
+	}
+	baseOffset, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+	// Names that parse but aren't how the log writes
+	// them, like "007.store", are someone else's.
+	if err != nil || segmentFile(baseOffset, ext) != name {
+		return 0, "", false
+	}
+	return baseOffset, ext, true
+}
+
+func hasExt(exts []string, ext string) bool {
+	for _, e := range exts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func sortOffsets(offsets []uint64) {
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsets[i] < offsets[j]
+	})
+}
+
+// gaps reports the offsets missing between each segment and the
+// next. It's called before linkSegments, while each segment's next
+// offset still comes from its own index, or from its store's header
+// if compaction removed the records at its end.
+func (l *Log) gaps() []*GapError {
+	var gaps []*GapError
+	for i := 0; i < len(l.segments)-1; i++ {
+		s, next := l.segments[i], l.segments[i+1]
+		if s.nextOffset < next.baseOffset {
+			gaps = append(gaps, &GapError{
+				Segment: s.baseOffset,
+				From:    s.nextOffset,
+				To:      next.baseOffset,
+			})
+		}
+	}
+	return gaps
+}
+
+// Discovery reports what the log found when it was opened that
+// doesn't fit a whole log: an *OrphanError for each base offset
+// with segment files but no store, and a *GapError for each run of
+// offsets missing between segments.
+func (l *Log) Discovery() []error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.discovered
+}
@@ -0,0 +1,150 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscovery(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string, c Config){
+		"stray files are ignored":         testDiscoverStray,
+		"orphaned index is reported":      testDiscoverOrphan,
+		"missing segment is a gap":        testDiscoverGap,
+		"read-only log reports the same":  testDiscoverReadOnly,
+		"compacting files need a segment": testDiscoverCompacting,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "discovery-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// Three records to a segment, so nine records
+			// make segments 0, 3 and 6, and an empty 9.
+			c := Config{}
+			c.Segment.MaxIndexBytes = entryWidth * 3
+
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			appendRecords(t, log, 9)
+			require.NoError(t, log.Close())
+
+			fn(t, dir, c)
+		})
+	}
+}
+
+// removeFiles removes the files of the segment with the given
+// base offset that have the given extensions.
+func removeFiles(t *testing.T, dir string, baseOffset uint64, exts ...string) {
+	t.Helper()
+
+	for _, ext := range exts {
+		require.NoError(t, os.Remove(path.Join(dir, segmentFile(baseOffset, ext))))
+	}
+}
+
+// requireOffsets checks that the log has a record at each offset.
+func requireOffsets(t *testing.T, log *Log, offsets ...uint64) {
+	t.Helper()
+
+	for _, offset := range offsets {
+		read, err := log.Read(offset)
+		require.NoError(t, err)
+		require.Equal(t, offset, read.Offset)
+	}
+}
+
+func testDiscoverStray(t *testing.T, dir string, c Config) {
+	for _, name := range []string{".DS_Store", "notes.txt", "007.store", "abc.index", "3.store.bak"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, name), []byte("stray"), 0644))
+	}
+	before := files(t, dir)
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, log.Discovery())
+	require.Empty(t, log.Recovery())
+	require.Len(t, log.segments, 4)
+	requireOffsets(t, log, 0, 1, 2, 3, 4, 5, 6, 7, 8)
+	require.NoError(t, log.Close())
+
+	require.Equal(t, before, files(t, dir))
+}
+
+// The newest segment loses its store, leaving its index files
+// behind. Appends roll into it again as if it were new.
+func testDiscoverOrphan(t *testing.T, dir string, c Config) {
+	removeFiles(t, dir, 9, storeExt)
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []error{&OrphanError{
+		Segment: 9,
+		Files:   []string{"9.index", "9.timeindex"},
+	}}, log.Discovery())
+	require.Len(t, log.segments, 3)
+	require.Contains(t, files(t, dir), "9.index")
+
+	appendRecords(t, log, 1)
+	requireOffsets(t, log, 8, 9)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Empty(t, log.Discovery())
+	requireOffsets(t, log, 9)
+}
+
+func testDiscoverGap(t *testing.T, dir string, c Config) {
+	removeFiles(t, dir, 3, storeExt, indexExt, timeIndexExt)
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, []error{&GapError{Segment: 0, From: 3, To: 6}}, log.Discovery())
+	require.EqualError(t, log.Discovery()[0], "log: offsets 3 to 5 are missing after segment 0")
+
+	requireOffsets(t, log, 0, 1, 2, 6, 7, 8)
+	require.Equal(t, []uint64{0, 1, 2, 6, 7, 8}, readOffsets(t, log, 0))
+}
+
+func testDiscoverReadOnly(t *testing.T, dir string, c Config) {
+	removeFiles(t, dir, 3, storeExt, indexExt, timeIndexExt)
+	removeFiles(t, dir, 9, storeExt)
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, ".DS_Store"), nil, 0644))
+	before := files(t, dir)
+
+	log, err := OpenReadOnly(dir)
+	require.NoError(t, err)
+	require.Equal(t, []error{
+		&OrphanError{Segment: 9, Files: []string{"9.index", "9.timeindex"}},
+		&GapError{Segment: 0, From: 3, To: 6},
+	}, log.Discovery())
+	requireOffsets(t, log, 0, 8)
+	require.NoError(t, log.Close())
+
+	require.Equal(t, before, files(t, dir))
+}
+
+// Only the leftovers of a compaction are removed,
+// not files that just end the same way.
+func testDiscoverCompacting(t *testing.T, dir string, c Config) {
+	for _, name := range []string{"3.store.compacting", "3.index.compacting", "notes.compacting"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, name), nil, 0644))
+	}
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Empty(t, log.Discovery())
+
+	names := files(t, dir)
+	require.NotContains(t, names, "3.store.compacting")
+	require.NotContains(t, names, "3.index.compacting")
+	require.Contains(t, names, "notes.compacting")
+}
@@ -0,0 +1,198 @@
+package log
+
+import (
+	"errors"
+	"time"
+)
+
+/*
+	Appends go to the store's buffer and the index's memory map, so
+	until they're synced a crash of the machine can lose them. How
+	often to sync is a tradeoff between append latency and how much
+	a crash can lose, so it's left to the durability mode.
+
+	The log counts the records and bytes appended since the last
+	sync. Syncs only ever cover the active segment, so before rolling
+	to a new segment the old one is synced if the mode calls for
+	syncing at all.
+
+	If writing to storage fails, whether it's a write, a sync or
+	removing a file, the log can't tell what made it to storage.
+	Retrying a failed sync can report success without the data on
+	disk, so instead the log fails: it returns a FailedError for
+	that call and every write after it, while reads of records in
+	storage keep working. Opening the log again recovers it the same
+	way as after a crash, keeping whatever made it to storage.
+	Failing to open a new segment doesn't fail the log, since
+	nothing was written yet. The append that needed it fails and the
+	next one tries again.
+*/
+
+// fail fails the log with the given error from writing to storage,
+// unless it's already failed, and returns the error the log failed
+// with. The caller must hold the write lock.
+func (l *Log) fail(op string, err error) error {
+	if l.failed == nil {
+		var failed *FailedError
+		if !errors.As(err, &failed) {
+			failed = &FailedError{Op: op, Err: err}
+		}
+		l.failed = failed
+		l.metrics.failures.Inc()
+	}
+	return l.failed
+}
+
+// check fails the log if err is from writing to storage and
+// returns err. The caller must hold the write lock.
+func (l *Log) check(err error) error {
+	if errors.Is(err, ErrFailed) {
+		return l.fail("", err)
+	}
+	return err
+}
+
+// checkWritable returns ErrReadOnly for a read-only log, or the
+// error the log failed with, if it has. The caller must hold the
+// lock.
+func (l *Log) checkWritable() error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	if l.failed != nil {
+		return l.failed
+	}
+	return nil
+}
+
+// commit is called after records are appended to the active
+// segment and syncs them if the durability mode calls for it.
+// The caller must hold the write lock.
+func (l *Log) commit() error {
+	d := l.Config.Durability
+	switch d.Mode {
+	case DurabilityAlways:
+		return l.sync()
+	case DurabilityEvery:
+		if d.EveryRecords == 0 && d.EveryBytes == 0 ||
+			d.EveryRecords != 0 && l.unsyncedRecords >= d.EveryRecords ||
+			d.EveryBytes != 0 && l.unsyncedBytes >= d.EveryBytes {
+			return l.sync()
+		}
+	}
+
+	return nil
+}
+
+// sync commits the active segment to stable storage if anything
+// was appended since it was last synced. A failed sync fails the
+// log. The caller must hold the write lock.
+func (l *Log) sync() error {
+	if l.unsyncedRecords == 0 {
+		return nil
+	}
+	if err := l.activeSegment.Sync(); err != nil {
+		return l.fail("sync", err)
+	}
+	l.unsyncedRecords = 0
+	l.unsyncedBytes = 0
+
+	return nil
+}
+
+// syncOnInterval is run in the background with DurabilityInterval.
+// There's no caller to hand a failed sync to, so the next append
+// returns it instead.
+func (l *Log) syncOnInterval() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.failed == nil {
+		l.sync()
+	}
+}
+
+// startBackground starts the goroutines that maintain the log
+// while it's open. Close stops them.
+func (l *Log) startBackground() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closing = make(chan struct{})
+	// Everything in the background writes to the log.
+	if l.Config.ReadOnly {
+		return
+	}
+
+	d := l.Config.Durability
+	if d.Mode == DurabilityInterval {
+		l.runEvery(d.Interval, l.syncOnInterval)
+	}
+	if l.Config.Segment.MaxAge > 0 {
+		l.runEvery(rollCheckInterval(l.Config.Segment.MaxAge), l.rollOnAge)
+	}
+	if l.Config.retains() {
+		l.runEvery(l.Config.Retention.CheckInterval, l.retain)
+	}
+	if l.Config.Compaction.Enabled {
+		l.runEvery(l.Config.Compaction.Interval, l.compactInBackground)
+	}
+	if d.GroupCommit.Enabled {
+		l.wg.Add(1)
+		go l.groupCommit(l.closing)
+	}
+}
+
+// minRollCheck is the shortest time between checks for
+// an active segment that's past the segment max age.
+const minRollCheck = time.Millisecond
+
+// rollCheckInterval returns how often to check whether the active
+// segment is past the given max age. A segment can expire just after
+// a check, so checking every max age could leave it open for almost
+// twice that, where checking at a tenth of it rolls at most a tenth
+// late.
+func rollCheckInterval(maxAge time.Duration) time.Duration {
+	if interval := maxAge / 10; interval > minRollCheck {
+		return interval
+	}
+	return minRollCheck
+}
+
+// runEvery calls fn in its own goroutine every interval
+// until the log is closed. The caller must hold the write lock.
+func (l *Log) runEvery(interval time.Duration, fn func()) {
+	closing := l.closing
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closing:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+}
+
+// stopBackground stops the goroutines started by startBackground
+// and waits for them to finish, reporting whether they were running.
+// The goroutines take the log's lock, so the caller must not hold it.
+func (l *Log) stopBackground() bool {
+	l.mu.Lock()
+	closing := l.closing
+	l.closing = nil
+	l.mu.Unlock()
+
+	if closing == nil {
+		return false
+	}
+	close(closing)
+	l.wg.Wait()
+
+	return true
+}
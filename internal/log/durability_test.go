@@ -0,0 +1,127 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurability(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string, c Config){
+		"os mode leaves records buffered": testDurabilityOS,
+		"always syncs every append":       testDurabilityAlways,
+		"every n records":                 testDurabilityEveryRecords,
+		"every n bytes":                   testDurabilityEveryBytes,
+		"interval syncs in background":    testDurabilityInterval,
+		"roll syncs the sealed segment":   testDurabilityRoll,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "durability-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+
+			fn(t, dir, c)
+		})
+	}
+}
+
+// unsynced reports whether the active segment's store
+// has records that haven't been flushed and synced.
+func unsynced(log *Log) bool {
+	log.mu.RLock()
+	defer log.mu.RUnlock()
+	return log.activeSegment.store.buf.Buffered() > 0 || log.unsyncedRecords > 0
+}
+
+func testDurabilityOS(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	appendRecords(t, log, 3)
+	require.True(t, unsynced(log))
+}
+
+func testDurabilityAlways(t *testing.T, dir string, c Config) {
+	c.Durability.Mode = DurabilityAlways
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 3; i++ {
+		appendRecords(t, log, 1)
+		require.False(t, unsynced(log))
+	}
+}
+
+func testDurabilityEveryRecords(t *testing.T, dir string, c Config) {
+	c.Durability.Mode = DurabilityEvery
+	c.Durability.EveryRecords = 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	appendRecords(t, log, 2)
+	require.True(t, unsynced(log))
+	appendRecords(t, log, 1)
+	require.False(t, unsynced(log))
+}
+
+func testDurabilityEveryBytes(t *testing.T, dir string, c Config) {
+	record := &api.Record{Value: []byte("hello world")}
+	c.Durability.Mode = DurabilityEvery
+	c.Durability.EveryBytes = 60
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// Each record takes up about 40 bytes in the store,
+	// and the first is written along with the store's header.
+	_, err = log.Append(record)
+	require.NoError(t, err)
+	require.True(t, unsynced(log))
+	_, err = log.Append(record)
+	require.NoError(t, err)
+	require.False(t, unsynced(log))
+}
+
+func testDurabilityInterval(t *testing.T, dir string, c Config) {
+	c.Durability.Mode = DurabilityInterval
+	c.Durability.Interval = 10 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	appendRecords(t, log, 3)
+	require.Eventually(t, func() bool {
+		return !unsynced(log)
+	}, time.Second, time.Millisecond)
+
+	// Closing stops the background sync, and
+	// the log can be opened again after.
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+}
+
+func testDurabilityRoll(t *testing.T, dir string, c Config) {
+	c.Segment.MaxStoreBytes = 100
+	c.Durability.Mode = DurabilityEvery
+	c.Durability.EveryRecords = 100
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	appendRecords(t, log, 3)
+	require.Len(t, log.segments, 2)
+	require.Zero(t, log.segments[0].store.buf.Buffered())
+	require.False(t, unsynced(log))
+}
@@ -0,0 +1,176 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrClosed is returned for operations on a closed log.
+	ErrClosed = errors.New("log: closed")
+
+	// ErrSegmentFull is returned when a segment's index has no room
+	// for another entry. The log rolls to a new segment when it sees it.
+	ErrSegmentFull = errors.New("log: segment full")
+
+	// ErrOffsetOutOfRange is matched by every error for reading an
+	// offset that's before the start of the log or hasn't been
+	// appended yet.
+	ErrOffsetOutOfRange = errors.New("log: offset out of range")
+
+	// ErrLocked is returned when opening a log whose files
+	// another log, possibly in another process, has open.
+	ErrLocked = errors.New("log: locked by another log")
+
+	// ErrReadOnly is returned for writes to a read-only log.
+	ErrReadOnly = errors.New("log: read-only")
+
+	// ErrEmpty is returned by HighestOffset for a log without
+	// any offsets, which has no highest one.
+	ErrEmpty = errors.New("log: empty")
+)
+
+// OffsetOutOfRangeError reports an offset the log doesn't have,
+// along with the range of offsets it did have at the time.
+type OffsetOutOfRangeError struct {
+	Offset uint64
+	// The log had the offsets from Lowest up to but not including
+	// Next, which is the offset the next record appended gets.
+	Lowest uint64
+	Next   uint64
+}
+
+func (e *OffsetOutOfRangeError) Error() string {
+	return fmt.Sprintf(
+		"log: offset out of range: %d (lowest is %d, next is %d)",
+		e.Offset, e.Lowest, e.Next,
+	)
+}
+
+// Is makes errors.Is(err, ErrOffsetOutOfRange) true for out of range errors.
+func (e *OffsetOutOfRangeError) Is(target error) bool {
+	return target == ErrOffsetOutOfRange
+}
+
+// ErrCorrupt is matched by every error that reports data on disk
+// that failed validation, so callers can check for it with errors.Is
+// without caring where the corruption was found.
+var ErrCorrupt = errors.New("log: corrupt data")
+
+// CorruptionError reports a record whose bytes on disk don't match
+// the checksum stored alongside them. That's bad data on disk, as
+// opposed to a bad offset asked for by the caller.
+type CorruptionError struct {
+	// Segment is the base offset of the segment holding the record.
+	Segment uint64
+	// Offset is the absolute offset of the record.
+	Offset uint64
+	// Position is where the record's frame starts in the store file.
+	Position uint64
+	// Reason describes what failed validation.
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf(
+		"log: corrupt record at offset %d (segment %d, position %d): %s",
+		e.Offset, e.Segment, e.Position, e.Reason,
+	)
+}
+
+// Is makes errors.Is(err, ErrCorrupt) true for corruption errors.
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// ErrUnsupportedFormat is matched by every error for a store written
+// in a format the log can't read, e.g. by a newer version of it.
+var ErrUnsupportedFormat = errors.New("log: unsupported store format")
+
+// UnsupportedFormatError reports a store whose header names a format
+// version the log doesn't know. The log refuses to open rather than
+// guess at the store's records.
+type UnsupportedFormatError struct {
+	// Segment is the base offset of the segment the store belongs to.
+	Segment uint64
+	// Version is the format version in the store's header.
+	Version uint32
+}
+
+func (e *UnsupportedFormatError) Error() string {
+	return fmt.Sprintf(
+		"log: segment %d's store is in unsupported format version %d",
+		e.Segment, e.Version,
+	)
+}
+
+// Is makes errors.Is(err, ErrUnsupportedFormat) true for format errors.
+func (e *UnsupportedFormatError) Is(target error) bool {
+	return target == ErrUnsupportedFormat
+}
+
+// ErrFailed is matched by every error for writing to a log whose
+// storage failed, e.g. because the disk filled up or a sync failed.
+var ErrFailed = errors.New("log: failed")
+
+// FailedError reports that writing to the log's storage failed.
+// After that the log can't tell what made it to storage, so it
+// refuses to write until it's opened again, which recovers it the
+// same way as after a crash. Records already written can still be
+// read.
+type FailedError struct {
+	// Op is what the log was doing when it failed, e.g. "sync".
+	Op string
+	// Err is the error from the backend.
+	Err error
+}
+
+func (e *FailedError) Error() string {
+	return fmt.Sprintf("log: failed to %s, reopen the log to recover: %v", e.Op, e.Err)
+}
+
+// Is makes errors.Is(err, ErrFailed) true for failed errors.
+func (e *FailedError) Is(target error) bool {
+	return target == ErrFailed
+}
+
+// Unwrap returns the error from the backend, so callers
+// can check for e.g. syscall.ENOSPC.
+func (e *FailedError) Unwrap() error {
+	return e.Err
+}
+
+// OrphanError reports segment files, such as an index, found for a
+// base offset that has no store. The log ignores them, since the
+// records they'd point at are gone.
+type OrphanError struct {
+	// Segment is the base offset the files are named for.
+	Segment uint64
+	// Files are the names of the orphaned files.
+	Files []string
+}
+
+func (e *OrphanError) Error() string {
+	return fmt.Sprintf(
+		"log: segment %d has no store, ignoring %s",
+		e.Segment, strings.Join(e.Files, ", "),
+	)
+}
+
+// GapError reports offsets missing between a segment and the one
+// after it, e.g. because a segment's files were removed.
+type GapError struct {
+	// Segment is the base offset of the segment before the gap.
+	Segment uint64
+	// The offsets from From up to but not including To are missing.
+	From uint64
+	To   uint64
+}
+
+func (e *GapError) Error() string {
+	return fmt.Sprintf(
+		"log: offsets %d to %d are missing after segment %d",
+		e.From, e.To-1, e.Segment,
+	)
+}
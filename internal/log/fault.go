@@ -0,0 +1,261 @@
+package log
+
+import (
+	"os"
+	"path"
+	"sync"
+)
+
+/*
+	The fault backend wraps another backend and makes chosen operations
+	fail, or quietly corrupt what they write or read, so tests can see
+	how the log behaves when storage goes wrong: a full disk, a write
+	cut short, a sync or a memory map that fails, or bits flipped on
+	the way to or from the disk.
+
+	Faults are scheduled by operation and file extension. A fault lets
+	a number of matching operations through before it fires, then
+	fires a number of times or for good. The log's behavior under each
+	fault is described in durability.go.
+*/
+
+// Op is an operation a fault can be injected into.
+type Op int
+
+const (
+	// OpOpen opens a file.
+	OpOpen Op = iota
+	// OpRead reads from a file.
+	OpRead
+	// OpWrite writes to a file.
+	OpWrite
+	// OpTruncate resizes a file.
+	OpTruncate
+	// OpSync syncs a file.
+	OpSync
+	// OpMap maps a file into memory.
+	OpMap
+	// OpMapSync syncs a file mapped into memory.
+	OpMapSync
+	// OpRemove removes a file.
+	OpRemove
+	// OpRename renames a file.
+	OpRename
+	// OpSyncDir syncs the backend's list of files.
+	OpSyncDir
+)
+
+// Fault describes the operations to fail and how to fail them.
+type Fault struct {
+	Op Op
+	// Ext limits the fault to files with this extension, e.g.
+	// ".store". Empty matches every file.
+	Ext string
+	// After is how many matching operations succeed before
+	// the fault fires.
+	After int
+	// Times is how many matching operations the fault fails once
+	// it fires. Zero fails every one after that.
+	Times int
+	// Err is returned by the operations that fail, e.g.
+	// syscall.ENOSPC.
+	Err error
+	// Short makes a failed write write the first half of its
+	// bytes before returning Err.
+	Short bool
+	// Corrupt makes a failed write or read succeed, but with a
+	// bit flipped in the bytes written or read. Err is ignored.
+	Corrupt bool
+}
+
+// FaultBackend is a backend whose operations fail on a schedule.
+type FaultBackend struct {
+	Backend
+
+	mu     sync.Mutex
+	faults []*fault
+}
+
+type fault struct {
+	Fault
+	seen  int
+	fired int
+}
+
+// NewFaultBackend returns a backend that passes operations through
+// to the given backend unless a fault injected into it fires.
+func NewFaultBackend(b Backend) *FaultBackend {
+	return &FaultBackend{Backend: b}
+}
+
+// Inject schedules the fault. Its After and Times count the
+// operations matching it from now on.
+func (b *FaultBackend) Inject(f Fault) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.faults = append(b.faults, &fault{Fault: f})
+}
+
+// Clear removes every fault, so operations succeed again.
+func (b *FaultBackend) Clear() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.faults = nil
+}
+
+// fire returns the fault that fires for the operation on the named
+// file, counting the operation towards each matching fault, or nil
+// if none fires.
+func (b *FaultBackend) fire(op Op, name string) *Fault {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var fired *Fault
+	for _, f := range b.faults {
+		if f.Op != op || f.Ext != "" && f.Ext != path.Ext(name) {
+			continue
+		}
+		f.seen++
+		if fired != nil || f.seen <= f.After || f.Times > 0 && f.fired == f.Times {
+			continue
+		}
+		f.fired++
+		fired = &f.Fault
+	}
+	return fired
+}
+
+func (b *FaultBackend) Open(name string) (File, error) {
+	if f := b.fire(OpOpen, name); f != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: f.Err}
+	}
+	f, err := b.Backend.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: f, backend: b, name: name}, nil
+}
+
+func (b *FaultBackend) OpenReadOnly(name string) (File, error) {
+	if f := b.fire(OpOpen, name); f != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: f.Err}
+	}
+	f, err := b.Backend.OpenReadOnly(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: f, backend: b, name: name}, nil
+}
+
+func (b *FaultBackend) Map(f File) (Mapping, error) {
+	return b.mapFile(f, b.Backend.Map)
+}
+
+func (b *FaultBackend) MapReadOnly(f File) (Mapping, error) {
+	return b.mapFile(f, b.Backend.MapReadOnly)
+}
+
+// mapFile maps the file opened by the backend with the given
+// function of the backend it wraps, unless a fault fires.
+func (b *FaultBackend) mapFile(f File, mapFn func(File) (Mapping, error)) (Mapping, error) {
+	ff := f.(*faultFile)
+	if fault := b.fire(OpMap, ff.name); fault != nil {
+		return nil, fault.Err
+	}
+	m, err := mapFn(ff.File)
+	if err != nil {
+		return nil, err
+	}
+	return &faultMapping{Mapping: m, backend: b, name: ff.name}, nil
+}
+
+func (b *FaultBackend) Remove(name string) error {
+	if f := b.fire(OpRemove, name); f != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: f.Err}
+	}
+	return b.Backend.Remove(name)
+}
+
+func (b *FaultBackend) Rename(oldname, newname string) error {
+	if f := b.fire(OpRename, oldname); f != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: f.Err}
+	}
+	return b.Backend.Rename(oldname, newname)
+}
+
+func (b *FaultBackend) Sync() error {
+	if f := b.fire(OpSyncDir, ""); f != nil {
+		return f.Err
+	}
+	return b.Backend.Sync()
+}
+
+// faultFile is a file opened by a FaultBackend.
+type faultFile struct {
+	File
+	backend *FaultBackend
+	// The name the file was opened with, which
+	// faults match on. Name returns the full path.
+	name string
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	fault := f.backend.fire(OpRead, f.name)
+	if fault != nil && !fault.Corrupt {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: fault.Err}
+	}
+	n, err := f.File.ReadAt(p, off)
+	if fault != nil && n > 0 {
+		p[n/2] ^= 1
+	}
+	return n, err
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	fault := f.backend.fire(OpWrite, f.name)
+	switch {
+	case fault == nil:
+		return f.File.WriteAt(p, off)
+	case fault.Corrupt:
+		corrupt := append([]byte(nil), p...)
+		if len(corrupt) > 0 {
+			corrupt[len(corrupt)/2] ^= 1
+		}
+		return f.File.WriteAt(corrupt, off)
+	case fault.Short:
+		n, err := f.File.WriteAt(p[:len(p)/2], off)
+		if err == nil {
+			err = &os.PathError{Op: "write", Path: f.name, Err: fault.Err}
+		}
+		return n, err
+	}
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: fault.Err}
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if fault := f.backend.fire(OpTruncate, f.name); fault != nil {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: fault.Err}
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultFile) Sync() error {
+	if fault := f.backend.fire(OpSync, f.name); fault != nil {
+		return &os.PathError{Op: "sync", Path: f.name, Err: fault.Err}
+	}
+	return f.File.Sync()
+}
+
+// faultMapping is a file mapped by a FaultBackend.
+type faultMapping struct {
+	Mapping
+	backend *FaultBackend
+	name    string
+}
+
+func (m *faultMapping) Sync() error {
+	if fault := m.backend.fire(OpMapSync, m.name); fault != nil {
+		return fault.Err
+	}
+	return m.Mapping.Sync()
+}
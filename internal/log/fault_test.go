@@ -0,0 +1,212 @@
+package log
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFault(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, b *FaultBackend, c Config){
+		"full disk fails the log":               testFaultFullDisk,
+		"short write is cut off on reopen":      testFaultShortWrite,
+		"failed sync fails the log":             testFaultSync,
+		"failed msync fails the log":            testFaultMapSync,
+		"failed mmap fails only the roll":       testFaultMap,
+		"corrupt write is caught on read":       testFaultCorruptWrite,
+		"corrupt read is caught":                testFaultCorruptRead,
+		"failed batch is rolled back on reopen": testFaultBatch,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+			c.Durability.Mode = DurabilityAlways
+
+			fn(t, NewFaultBackend(NewMemoryBackend()), c)
+		})
+	}
+}
+
+// requireFailed checks that appending to the log fails with the
+// error the log failed with, e.g. syscall.ENOSPC.
+func requireFailed(t *testing.T, log *Log, cause error) {
+	t.Helper()
+
+	_, err := log.Append(&api.Record{Value: write})
+	require.ErrorIs(t, err, ErrFailed)
+	require.ErrorIs(t, err, cause)
+
+	var failed *FailedError
+	require.True(t, errors.As(err, &failed))
+}
+
+// reopen closes the failed log, clears the faults and
+// opens the log again, checking it has the given records.
+func reopen(t *testing.T, log *Log, b *FaultBackend, c Config, records uint64) *Log {
+	t.Helper()
+
+	log.Close()
+	b.Clear()
+	log, err := NewLogWithBackend(b, c)
+	require.NoError(t, err)
+
+	for offset := uint64(0); offset < records; offset++ {
+		read, err := log.Read(offset)
+		require.NoError(t, err)
+		require.Equal(t, offset, read.Offset)
+	}
+	offset, err := log.Append(&api.Record{Value: write})
+	require.NoError(t, err)
+	require.Equal(t, records, offset)
+
+	return log
+}
+
+func testFaultFullDisk(t *testing.T, b *FaultBackend, c Config) {
+	log, err := NewLogWithBackend(b, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 3)
+
+	b.Inject(Fault{Op: OpWrite, Ext: storeExt, Err: syscall.ENOSPC})
+	requireFailed(t, log, syscall.ENOSPC)
+	requireFailed(t, log, syscall.ENOSPC)
+	_, _, err = log.AppendBatch(batchOf(2))
+	require.ErrorIs(t, err, ErrFailed)
+	require.ErrorIs(t, log.Truncate(0), ErrFailed)
+
+	// Records written before the disk filled up can still be read.
+	read, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), read.Offset)
+
+	log = reopen(t, log, b, c, 3)
+	require.NoError(t, log.Close())
+}
+
+func testFaultShortWrite(t *testing.T, b *FaultBackend, c Config) {
+	log, err := NewLogWithBackend(b, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 3)
+
+	b.Inject(Fault{Op: OpWrite, Ext: storeExt, Short: true, Err: syscall.ENOSPC})
+	requireFailed(t, log, syscall.ENOSPC)
+
+	log = reopen(t, log, b, c, 3)
+	defer log.Close()
+	require.Len(t, log.Recovery(), 1)
+	require.NotZero(t, log.Recovery()[0].StoreBytes)
+}
+
+// The record made it to the file before the sync failed, so it's
+// kept when the log is opened again even though the append failed.
+func testFaultSync(t *testing.T, b *FaultBackend, c Config) {
+	log, err := NewLogWithBackend(b, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 3)
+
+	b.Inject(Fault{Op: OpSync, Ext: storeExt, Err: syscall.EIO})
+	requireFailed(t, log, syscall.EIO)
+	requireFailed(t, log, syscall.EIO)
+
+	read, err := log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), read.Offset)
+
+	log = reopen(t, log, b, c, 4)
+	require.NoError(t, log.Close())
+}
+
+func testFaultMapSync(t *testing.T, b *FaultBackend, c Config) {
+	log, err := NewLogWithBackend(b, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 3)
+
+	b.Inject(Fault{Op: OpMapSync, Ext: indexExt, Err: syscall.EIO})
+	requireFailed(t, log, syscall.EIO)
+
+	log = reopen(t, log, b, c, 4)
+	require.NoError(t, log.Close())
+}
+
+// Small segments make the log roll after every record, and rolling
+// maps the new segment's index.
+func testFaultMap(t *testing.T, b *FaultBackend, c Config) {
+	c.Segment.MaxStoreBytes = 1
+	log, err := NewLogWithBackend(b, c)
+	require.NoError(t, err)
+
+	b.Inject(Fault{Op: OpMap, Err: syscall.ENOMEM})
+	// The record is appended even though rolling after it fails.
+	offset, err := log.Append(&api.Record{Value: write})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+	require.Len(t, log.segments, 1)
+
+	// The next append has to roll first, so it fails without the log failing.
+	_, err = log.Append(&api.Record{Value: write})
+	require.ErrorIs(t, err, syscall.ENOMEM)
+	require.False(t, errors.Is(err, ErrFailed))
+
+	b.Clear()
+	offset, err = log.Append(&api.Record{Value: write})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), offset)
+	require.Len(t, log.segments, 3)
+
+	log = reopen(t, log, b, c, 2)
+	require.NoError(t, log.Close())
+}
+
+func testFaultCorruptWrite(t *testing.T, b *FaultBackend, c Config) {
+	log, err := NewLogWithBackend(b, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendRecords(t, log, 1)
+
+	b.Inject(Fault{Op: OpWrite, Ext: storeExt, Corrupt: true, Times: 1})
+	appendRecords(t, log, 2)
+
+	_, err = log.Read(1)
+	require.ErrorIs(t, err, ErrCorrupt)
+	for _, offset := range []uint64{0, 2} {
+		read, err := log.Read(offset)
+		require.NoError(t, err)
+		require.Equal(t, offset, read.Offset)
+	}
+}
+
+func testFaultCorruptRead(t *testing.T, b *FaultBackend, c Config) {
+	log, err := NewLogWithBackend(b, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendRecords(t, log, 1)
+
+	b.Inject(Fault{Op: OpRead, Ext: storeExt, Corrupt: true, Times: 1})
+	_, err = log.Read(0)
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	// What's on disk is fine, so reading it again works.
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, write, read.Value)
+}
+
+func testFaultBatch(t *testing.T, b *FaultBackend, c Config) {
+	c.Durability.Mode = DurabilityOS
+	log, err := NewLogWithBackend(b, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 1)
+
+	b.Inject(Fault{Op: OpSync, Ext: storeExt, Err: syscall.EIO})
+	_, _, err = log.AppendBatch(batchOf(3))
+	require.ErrorIs(t, err, ErrFailed)
+	require.ErrorIs(t, err, syscall.EIO)
+
+	log = reopen(t, log, b, c, 1)
+	defer log.Close()
+	require.Equal(t, uint64(3), log.Recovery()[0].RolledBack)
+}
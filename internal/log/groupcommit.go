@@ -0,0 +1,132 @@
+package log
+
+import (
+	"time"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+)
+
+/*
+	When every append has to be synced, appending one record at a time
+	caps throughput at how many syncs the disk can do a second. Group
+	commit gets around that by having concurrent callers hand their
+	records to a single goroutine. It gathers the records that arrive
+	within a short window, appends them all under one lock and syncs
+	once for the whole batch, then hands each caller back its offset.
+*/
+
+type appendRequest struct {
+	record *api.Record
+	done   chan appendResult
+}
+
+type appendResult struct {
+	offset uint64
+	err    error
+}
+
+// groupAppend hands the record to the group commit goroutine
+// and waits for it to be committed along with the rest of its batch.
+func (l *Log) groupAppend(record *api.Record) (uint64, error) {
+	l.mu.RLock()
+	closing := l.closing
+	err := l.checkWritable()
+	l.mu.RUnlock()
+	if closing == nil {
+		return 0, ErrClosed
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	req := &appendRequest{
+		record: record,
+		done:   make(chan appendResult, 1),
+	}
+	select {
+	case l.appends <- req:
+	case <-closing:
+		return 0, ErrClosed
+	}
+
+	res := <-req.done
+	return res.offset, res.err
+}
+
+// groupCommit gathers appends into batches and commits them
+// until the log is closed.
+func (l *Log) groupCommit(closing chan struct{}) {
+	defer l.wg.Done()
+
+	gc := l.Config.Durability.GroupCommit
+	for {
+		var batch []*appendRequest
+		select {
+		case req := <-l.appends:
+			batch = append(batch, req)
+		case <-closing:
+			return
+		}
+
+		var timer *time.Timer
+		var window <-chan time.Time
+		if gc.Window > 0 {
+			timer = time.NewTimer(gc.Window)
+			window = timer.C
+		}
+
+	gather:
+		for gc.MaxRecords == 0 || len(batch) < gc.MaxRecords {
+			if window == nil {
+				// Without a window, take only what's already waiting.
+				select {
+				case req := <-l.appends:
+					batch = append(batch, req)
+				default:
+					break gather
+				}
+				continue
+			}
+			select {
+			case req := <-l.appends:
+				batch = append(batch, req)
+			case <-window:
+				break gather
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		l.commitBatch(batch)
+	}
+}
+
+// commitBatch appends the batch's records and syncs them once, then
+// completes each caller. A record that fails to append fails only its
+// own caller, but a failed sync, or a failed log, fails the whole batch.
+func (l *Log) commitBatch(batch []*appendRequest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	results := make([]appendResult, len(batch))
+	err := l.checkWritable()
+	for i, req := range batch {
+		if err != nil {
+			break
+		}
+		results[i].offset, results[i].err = l.append(req.record)
+		err = l.checkWritable()
+	}
+	if err == nil {
+		err = l.commit()
+	}
+	l.notify()
+
+	for i, req := range batch {
+		if err != nil && results[i].err == nil {
+			results[i] = appendResult{err: err}
+		}
+		req.done <- results[i]
+	}
+}
@@ -0,0 +1,97 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupCommit(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"concurrent appends get their own offsets": testGroupCommitConcurrent,
+		"a batch is appended and synced together":  testGroupCommitBatch,
+		"append after close fails":                 testGroupCommitClosed,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "group-commit-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 256
+			c.Durability.Mode = DurabilityAlways
+			c.Durability.GroupCommit.Enabled = true
+			c.Durability.GroupCommit.Window = time.Millisecond
+
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			fn(t, log)
+		})
+	}
+}
+
+func testGroupCommitConcurrent(t *testing.T, log *Log) {
+	const appenders = 50
+
+	var wg sync.WaitGroup
+	offsets := make([]uint64, appenders)
+	errs := make([]error, appenders)
+	for i := 0; i < appenders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			offsets[i], errs[i] = log.Append(&api.Record{
+				Value: []byte(fmt.Sprintf("record %d", i)),
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	// Every caller gets a different offset that
+	// reads back the record it appended.
+	seen := make(map[uint64]bool)
+	for i := 0; i < appenders; i++ {
+		require.NoError(t, errs[i])
+		require.False(t, seen[offsets[i]])
+		seen[offsets[i]] = true
+
+		read, err := log.Read(offsets[i])
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(read.Value))
+	}
+	require.Greater(t, len(log.segments), 1)
+}
+
+func testGroupCommitBatch(t *testing.T, log *Log) {
+	var batch []*appendRequest
+	for i := 0; i < 3; i++ {
+		batch = append(batch, &appendRequest{
+			record: &api.Record{Value: []byte("hello world")},
+			done:   make(chan appendResult, 1),
+		})
+	}
+
+	log.commitBatch(batch)
+	for i, req := range batch {
+		res := <-req.done
+		require.NoError(t, res.err)
+		require.Equal(t, uint64(i), res.offset)
+	}
+	require.False(t, unsynced(log))
+}
+
+func testGroupCommitClosed(t *testing.T, log *Log) {
+	appendRecords(t, log, 1)
+	require.NoError(t, log.Close())
+
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrClosed, err)
+}
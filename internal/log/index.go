@@ -2,9 +2,7 @@ package log
 
 import (
 	"io"
-	"os"
-
-	"github.com/tysonmote/gommap"
+	"sort"
 )
 
 var (
@@ -19,12 +17,20 @@ var (
 )
 
 type index struct {
-	file *os.File
+	file File
 	// https://en.wikipedia.org/wiki/Memory-mapped_file
-	mmap gommap.MMap
+	mapping Mapping
+	mmap    []byte
 	// Size of the index and where to write the
 	// next entry appended to the index.
 	size uint64
+	// Set for the indexes of read-only logs, which are mapped read
+	// only and never resized. If one has to be rebuilt, it's copied
+	// into memory first and rebuilt there.
+	readOnly bool
+	detached bool
+	// What the index reports to its log's metrics registry.
+	metrics *logMetrics
 }
 
 /*
@@ -49,42 +55,110 @@ type index struct {
 // file as more index entries are added. Grow the file to
 // the max index size before memory-mapping the file and
 // return the created index to the caller.
-func newIndex(f *os.File, c Config) (*index, error) {
+func newIndex(f File, b Backend, c Config) (*index, error) {
 	index := &index{
-		file: f,
+		file:     f,
+		readOnly: c.ReadOnly,
+		metrics:  noMetrics,
 	}
 
-	file, err := os.Stat(f.Name())
+	file, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
+	if c.ReadOnly {
+		return index, index.mapReadOnly(b, file.Size())
+	}
 
 	index.size = uint64(file.Size())
-	if err = os.Truncate(
-		f.Name(),
-		int64(c.Segment.MaxIndexBytes),
-	); err != nil {
+	// An index written before the max size was lowered keeps its
+	// entries, so it's mapped at its own size rather than cut back.
+	size := c.Segment.MaxIndexBytes
+	if index.size > size {
+		size = index.size
+	}
+	if err = f.Truncate(int64(size)); err != nil {
 		return nil, err
 	}
 
-	if index.mmap, err = gommap.Map(
-		index.file.Fd(),
-		gommap.PROT_READ|gommap.PROT_WRITE,
-		gommap.MAP_SHARED,
-	); err != nil {
+	if index.mapping, err = b.Map(f); err != nil {
 		return nil, err
 	}
+	index.mmap = index.mapping.Bytes()
 
 	return index, nil
 }
 
+// mapReadOnly maps the index's file of the given size for a
+// read-only log, as it is. An empty file can't be mapped, so
+// it's left unmapped.
+func (i *index) mapReadOnly(b Backend, size int64) error {
+	if size == 0 {
+		i.mapping = memoryMapping(nil)
+		return nil
+	}
+	var err error
+	if i.mapping, err = b.MapReadOnly(i.file); err != nil {
+		return err
+	}
+	i.mmap = i.mapping.Bytes()
+	i.size = uint64(len(i.mmap))
+	return nil
+}
+
+// detach copies a read-only index into memory, where it can be
+// written to, with room for at least the given number of entries.
+func (i *index) detach(entries uint64) error {
+	mmap := make([]byte, entries*entryWidth)
+	copy(mmap, i.mmap)
+	if err := i.mapping.Unmap(); err != nil {
+		return err
+	}
+	i.mapping = memoryMapping(mmap)
+	i.mmap = mmap
+	if i.size > uint64(len(mmap)) {
+		i.size = uint64(len(mmap))
+	}
+	i.detached = true
+	return nil
+}
+
+// grow makes room in the index for at least the given number of
+// entries, past its max size if it has to, so that rebuilding it
+// can index every record in the store. A read-only index is grown
+// in memory.
+func (i *index) grow(b Backend, entries uint64) error {
+	size := entries * entryWidth
+	if size <= uint64(len(i.mmap)) {
+		return nil
+	}
+	if i.readOnly {
+		return i.detach(entries)
+	}
+
+	if err := i.mapping.Unmap(); err != nil {
+		return err
+	}
+	i.mmap = nil
+	if err := i.file.Truncate(int64(size)); err != nil {
+		return err
+	}
+	var err error
+	if i.mapping, err = b.Map(i.file); err != nil {
+		return err
+	}
+	i.mmap = i.mapping.Bytes()
+	return nil
+}
+
 // Read takes in an offset and returns the associated record's position in
 // the store. The given offset is relative to the segment's base offset:
 // 0 is the index's first entry's offset, 1 is the second entry and so on.
 // Relative offsets of uint32 are used to reduce the index size. If absolute
 // offsets are used then they'd have to be stored as uint64 and then will need
 // four more bytes for each entry. That adds up for billions to trillions
-// of records.
+// of records. Reading past the last entry, such as from an empty index,
+// returns io.EOF.
 func (i *index) Read(in int64) (out uint32, position uint64, err error) {
 	if i.size == 0 {
 		return 0, 0, io.EOF
@@ -106,39 +180,119 @@ func (i *index) Read(in int64) (out uint32, position uint64, err error) {
 	return out, position, nil
 }
 
+// Search returns the slot and entry of the first record at or after
+// the given relative offset. Compaction leaves gaps in a segment's
+// offsets, so a record's entry isn't always in the slot numbered by
+// its relative offset. Without gaps it is, so that slot is checked
+// before searching. Searching past the last entry returns io.EOF.
+func (i *index) Search(in uint32) (slot int64, out uint32, position uint64, err error) {
+	entries := int64(i.size / entryWidth)
+	if int64(in) < entries {
+		if out, position, err = i.Read(int64(in)); err == nil && out == in {
+			return int64(in), out, position, nil
+		}
+	}
+
+	slot = int64(sort.Search(int(entries), func(j int) bool {
+		out, _, err := i.Read(int64(j))
+		return err != nil || out >= in
+	}))
+	if slot == entries {
+		return 0, 0, 0, io.EOF
+	}
+	out, position, err = i.Read(slot)
+
+	return slot, out, position, err
+}
+
 // Write appends the given offset and position to the index.
 // Validate that space is available to write the entry. Next,
 // encode the offset and position and then write them to the
 // memory-mapped file. Finally, increment the position where
-// the next write will go.
+// the next write will go. A full index returns ErrSegmentFull.
 func (i *index) Write(offset uint32, position uint64) error {
 	if uint64(len(i.mmap)) < i.size+entryWidth {
-		return io.EOF
+		return ErrSegmentFull
 	}
 
 	enc.PutUint32(i.mmap[i.size:i.size+offsetWidth], offset)
 	enc.PutUint64(i.mmap[i.size+offsetWidth:i.size+entryWidth], position)
 	i.size += uint64(entryWidth)
+	i.metrics.indexEntries.Inc()
 
 	return nil
 }
 
+// written returns the number of entries up to and including the
+// last one holding any data, ignoring zero-filled space after it.
+func (i *index) written() uint64 {
+	for j := i.size; j > 0; j-- {
+		if i.mmap[j-1] != 0 {
+			return (j-1)/entryWidth + 1
+		}
+	}
+	return 0
+}
+
+// Truncate drops every entry from the given relative offset onwards.
+// The dropped entries are zeroed so they can't be mistaken for real
+// entries if the service stops before the index is closed.
+func (i *index) Truncate(entries uint64) {
+	size := entries * entryWidth
+	if size >= i.size {
+		return
+	}
+	if i.readOnly && !i.detached {
+		i.size = size
+		return
+	}
+	for j := size; j < i.size && j < uint64(len(i.mmap)); j++ {
+		i.mmap[j] = 0
+	}
+	i.size = size
+}
+
+// Sync commits the entries written to the memory-mapped
+// file to stable storage, waiting until they're written.
+func (i *index) Sync() error {
+	if err := i.mapping.Sync(); err != nil {
+		return err
+	}
+	i.metrics.indexSyncs.Inc()
+	return nil
+}
+
 // Close ensures the memory-mapped file has synced its data to
 // the persisted file and has flushed its contents to stable
-// storage. Then truncates the persisted file to the amount
-// of data that's actually in it and closes the file.
+// storage. Then unmaps the file, truncates it to the amount
+// of data that's actually in it and closes the file. The file
+// is unmapped and closed even if syncing it fails.
 func (i *index) Close() error {
-	if err := i.mmap.Sync(gommap.MS_ASYNC); err != nil {
+	if i.readOnly {
+		err := i.mapping.Unmap()
+		i.mmap = nil
+		if cerr := i.file.Close(); err == nil {
+			err = cerr
+		}
 		return err
 	}
-	if err := i.file.Sync(); err != nil {
-		return err
+
+	err := i.mapping.Sync()
+	if err == nil {
+		err = i.file.Sync()
 	}
-	if err := i.file.Truncate(int64(i.size)); err != nil {
-		return err
+	if uerr := i.mapping.Unmap(); err == nil {
+		err = uerr
+	}
+	i.mmap = nil
+	if err == nil {
+		err = i.file.Truncate(int64(i.size))
+	}
+	if cerr := i.file.Close(); err == nil {
+		err = cerr
 	}
 
-	return i.file.Close()
+	return err
 }
 
 func (i *index) Name() string {
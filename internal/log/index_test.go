@@ -22,7 +22,7 @@ func TestIndex(t *testing.T) {
 	c := Config{}
 	c.Segment.MaxIndexBytes = 1024
 
-	index, err := newIndex(f, c)
+	index, err := newIndex(f, NewDirBackend(os.TempDir()), c)
 	require.NoError(t, err)
 
 	_, _, err = index.Read(-1)
@@ -58,10 +58,52 @@ func TestIndex(t *testing.T) {
 	// Index should build its state from the existing file,
 	// for when the service restarts with existing data.
 	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
-	index, err = newIndex(f, c)
+	index, err = newIndex(f, NewDirBackend(os.TempDir()), c)
 	require.NoError(t, err)
 	offset, position, err := index.Read(-1)
 	require.NoError(t, err)
 	require.Equal(t, uint32(1), offset)
 	require.Equal(t, entries[1].Position, position)
 }
+
+// Compaction leaves gaps in the offsets, so searching
+// finds the first entry at or after the offset.
+func TestIndexSearch(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_search_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	index, err := newIndex(f, NewDirBackend(os.TempDir()), c)
+	require.NoError(t, err)
+
+	_, _, _, err = index.Search(0)
+	require.Equal(t, io.EOF, err)
+
+	for i, off := range []uint32{0, 1, 4, 7} {
+		require.NoError(t, index.Write(off, uint64(i)*10))
+	}
+
+	for _, tc := range []struct {
+		in       uint32
+		slot     int64
+		out      uint32
+		position uint64
+	}{
+		{in: 0, slot: 0, out: 0, position: 0},
+		{in: 1, slot: 1, out: 1, position: 10},
+		{in: 2, slot: 2, out: 4, position: 20},
+		{in: 4, slot: 2, out: 4, position: 20},
+		{in: 5, slot: 3, out: 7, position: 30},
+	} {
+		slot, out, position, err := index.Search(tc.in)
+		require.NoError(t, err)
+		require.Equal(t, tc.slot, slot)
+		require.Equal(t, tc.out, out)
+		require.Equal(t, tc.position, position)
+	}
+
+	_, _, _, err = index.Search(8)
+	require.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,135 @@
+package log
+
+import (
+	"io"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+)
+
+/*
+	Reading a log from start to finish with Read means looking up the
+	segment and the index entry for every record. Records are stored
+	one after another though, so once an iterator has found its first
+	record it can keep reading the store from where the last record
+	ended and only has to look at the index again when it moves to
+	the next segment.
+*/
+
+// Iterator reads the records of a log in order of their offsets.
+// Reaching the end of the log isn't final: records appended after
+// Next returns false are read by calling Next again.
+//
+//	it := log.Iterator(0)
+//	for it.Next() {
+//		record := it.Record()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type Iterator struct {
+	log *Log
+	// The segment being read and the position in its
+	// store of the record with the next offset.
+	segment  *segment
+	position uint64
+	offset   uint64
+
+	record *api.Record
+	err    error
+}
+
+// Iterator returns an iterator that starts reading at the given offset.
+func (l *Log) Iterator(from uint64) *Iterator {
+	return &Iterator{
+		log:    l,
+		offset: from,
+	}
+}
+
+// Next reads the next record, making it available through Record. It
+// returns false once the iterator has read every record in the log or
+// if it fails, which Err tells apart.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	it.log.mu.RLock()
+	defer it.log.mu.RUnlock()
+
+	if it.err = it.log.checkOpen(); it.err != nil {
+		return false
+	}
+
+	// Compaction can leave the end of a segment's store
+	// short of its next offset, and replaces the segments
+	// it rewrites, closing the old ones.
+	s := it.segment
+	if s == nil || s.closed || it.offset >= s.nextOffset || it.position >= s.store.size {
+		if s = it.seek(); s == nil {
+			return false
+		}
+	}
+
+	record, next, err := s.readAt(it.offset, it.position)
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.record = record
+	it.offset = record.Offset + 1
+	it.position = next
+
+	return true
+}
+
+// seek finds the segment and position in its store of the next record
+// to read. It returns nil when there's no record there, either because
+// it hasn't been appended yet or because of an error. The caller must
+// hold the lock.
+func (it *Iterator) seek() *segment {
+	for {
+		s := it.log.findSegment(it.offset)
+		if s == nil {
+			// Records before the start of the log have been truncated
+			// away, but reaching the end is only the end for now.
+			if it.offset < it.log.segments[0].baseOffset {
+				it.err = it.log.outOfRange(it.offset)
+			}
+			return nil
+		}
+
+		// The record at the offset may have been compacted away,
+		// so start from the first record at or after it, which
+		// may be in a later segment.
+		_, _, position, err := s.index.Search(uint32(it.offset - s.baseOffset))
+		if err == io.EOF && s != it.log.activeSegment {
+			it.offset = s.nextOffset
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return nil
+		}
+
+		it.segment = s
+		it.position = position
+
+		return s
+	}
+}
+
+// Record returns the record read by the last call to Next.
+func (it *Iterator) Record() *api.Record {
+	return it.record
+}
+
+// Offset returns the offset of the next record the iterator will read.
+func (it *Iterator) Offset() uint64 {
+	return it.offset
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,96 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterator(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"reads across segments":           testIteratorSegments,
+		"starts from an offset":           testIteratorFrom,
+		"picks up records appended later": testIteratorFollow,
+		"truncated offset is an error":    testIteratorTruncated,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "iterator-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 64
+
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			fn(t, log)
+		})
+	}
+}
+
+// requireIterates checks that the iterator reads
+// the records with offsets [from, to) in order.
+func requireIterates(t *testing.T, it *Iterator, from, to uint64) {
+	t.Helper()
+
+	for offset := from; offset < to; offset++ {
+		require.True(t, it.Next(), it.Err())
+		require.Equal(t, offset, it.Record().Offset)
+		require.Equal(t, fmt.Sprintf("record %d", offset), string(it.Record().Value))
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+	require.Equal(t, to, it.Offset())
+}
+
+func appendNumbered(t *testing.T, log *Log, from, to uint64) {
+	t.Helper()
+
+	for i := from; i < to; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+}
+
+func testIteratorSegments(t *testing.T, log *Log) {
+	appendNumbered(t, log, 0, 10)
+	require.Greater(t, len(log.segments), 2)
+
+	requireIterates(t, log.Iterator(0), 0, 10)
+}
+
+func testIteratorFrom(t *testing.T, log *Log) {
+	appendNumbered(t, log, 0, 10)
+
+	requireIterates(t, log.Iterator(5), 5, 10)
+	requireIterates(t, log.Iterator(10), 10, 10)
+}
+
+func testIteratorFollow(t *testing.T, log *Log) {
+	it := log.Iterator(0)
+	require.False(t, it.Next())
+
+	appendNumbered(t, log, 0, 3)
+	requireIterates(t, it, 0, 3)
+
+	// Enough to roll past the segment the iterator is in.
+	appendNumbered(t, log, 3, 10)
+	requireIterates(t, it, 3, 10)
+}
+
+func testIteratorTruncated(t *testing.T, log *Log) {
+	appendNumbered(t, log, 0, 10)
+	it := log.Iterator(0)
+	require.True(t, it.Next())
+
+	require.NoError(t, log.Truncate(5))
+	for it.Next() {
+	}
+	require.Error(t, it.Err())
+}
@@ -1,30 +1,67 @@
 package log
 
 import (
-	"fmt"
+	"errors"
 	"io"
-	"io/ioutil"
-	"os"
-	"path"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"time"
 
-	api "github.com/jimxshaw/loglib/api/v1"
+	api "github.com/jimxshaw/loglib/api/v2"
+	"google.golang.org/protobuf/proto"
 )
 
 // The log consists of a list of segments and
 // a pointer to the active segment to append
-// writes to. The directory stores segments.
+// writes to. The backend stores segments.
 type Log struct {
 	mu sync.RWMutex
+	// Held for the whole of a compaction, which reads sealed
+	// segments without mu. Anything that closes or removes
+	// segments takes it before mu.
+	compacting sync.Mutex
 
+	// Dir is the directory the log is kept in, and
+	// empty for logs on other backends.
 	Dir    string
 	Config Config
 
+	// Where the segments' files are kept, and the
+	// backend's lock, held while the log is open.
+	backend Backend
+	lock    io.Closer
+
 	activeSegment *segment
 	segments      []*segment
+
+	// How segments were repaired the last time
+	// the log was set up.
+	recovery []RecoveryReport
+	// Orphaned files and gaps between segments found
+	// the last time the log was set up.
+	discovered []error
+
+	// Records and bytes appended since the active
+	// segment was last synced.
+	unsyncedRecords uint64
+	unsyncedBytes   uint64
+	// Set once writing to storage fails, after which
+	// the log refuses to write until it's reopened.
+	failed *FailedError
+
+	// Closed to stop the background goroutines.
+	closing chan struct{}
+	wg      sync.WaitGroup
+
+	// Appends waiting on group commit.
+	appends chan *appendRequest
+	// Closed when records are appended, to wake subscribers.
+	appended chan struct{}
+
+	// Recently read records, if the log caches them.
+	cache *recordCache
+	// What the log reports to Config.Metrics.Registry.
+	metrics *logMetrics
 }
 
 type originReader struct {
@@ -32,51 +69,106 @@ type originReader struct {
 	offset int64
 }
 
-// Set config defaults if the caller didn't specify,
-// create a log instance and set up the instance.
+// NewLog opens the log kept in the given directory,
+// creating it if it doesn't exist yet.
 func NewLog(dir string, c Config) (*Log, error) {
+	l, err := NewLogWithBackend(NewDirBackend(dir), c)
+	if err != nil {
+		return nil, err
+	}
+	l.Dir = dir
+	return l, nil
+}
+
+// Set config defaults if the caller didn't specify,
+// create a log instance on the given backend and
+// set up the instance.
+func NewLogWithBackend(b Backend, c Config) (*Log, error) {
 	if c.Segment.MaxStoreBytes == 0 {
 		c.Segment.MaxStoreBytes = 1024
 	}
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Segment.TimeIndexBytes == 0 {
+		c.Segment.TimeIndexBytes = 4096
+	}
+	if c.Durability.Mode == DurabilityInterval && c.Durability.Interval == 0 {
+		c.Durability.Interval = time.Second
+	}
+	if c.Retention.CheckInterval == 0 {
+		c.Retention.CheckInterval = time.Minute
+	}
+	if c.Compaction.Interval == 0 {
+		c.Compaction.Interval = time.Minute
+	}
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Config:   c,
+		backend:  b,
+		appends:  make(chan *appendRequest),
+		appended: make(chan struct{}),
+		cache:    newRecordCache(c.Cache.MaxBytes),
+		metrics:  newLogMetrics(c),
 	}
-	return l, l.setup()
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	l.registerGauges()
+	return l, nil
+}
+
+// open locks the backend, unless the log is read-only, sets up the
+// log's segments and starts the background goroutines. If the
+// backend is already locked, it returns ErrLocked.
+func (l *Log) open() error {
+	if !l.Config.ReadOnly {
+		lock, err := l.backend.Lock()
+		if err != nil {
+			return err
+		}
+		l.lock = lock
+	}
+	// The log's gauges can be read while a reset log is set up.
+	l.mu.Lock()
+	err := l.setup()
+	l.mu.Unlock()
+	if err != nil {
+		if l.lock != nil {
+			l.lock.Close()
+			l.lock = nil
+		}
+		return err
+	}
+	l.startBackground()
+	return nil
 }
 
 // When a log starts, set itself up for for segments already
 // exist on disk or if the leg is new and has no segments
 // then bootstraping the initial segment.
 func (l *Log) setup() error {
-	files, err := ioutil.ReadDir(l.Dir)
+	names, err := l.backend.List()
 	if err != nil {
 		return err
 	}
 
-	// Fetch the list of segments on disk, parse and sort the
-	// base offsets in order from oldest to newest.
-	var baseOffsets []uint64
-	for _, file := range files {
-		offStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		off, _ := strconv.ParseUint(offStr, 10, 0)
-		baseOffsets = append(baseOffsets, off)
-	}
+	found := discover(names)
 
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
+	// What's left of a compaction that didn't finish, or one
+	// that's running for a read-only log. The segment it was
+	// rewriting is still whole.
+	if !l.Config.ReadOnly {
+		for _, name := range found.compacting {
+			if err = l.backend.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
 
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+	for _, baseOffset := range found.segments {
+		if err = l.newSegment(baseOffset); err != nil {
 			return err
 		}
-		// baseOffSet contains duplicate for index and store so
-		// skip the duplicate.
-		i++
 	}
 
 	if l.segments == nil {
@@ -85,77 +177,379 @@ func (l *Log) setup() error {
 		}
 	}
 
+	// Only the active segment was being written to, so it's the only
+	// one that can have been left half-written by a crash.
+	trimmed, err := l.activeSegment.trimStore()
+	if err != nil {
+		return err
+	}
+	l.activeSegment.recovered.Segment = l.activeSegment.baseOffset
+	l.activeSegment.recovered.StoreBytes += trimmed
+
+	// There's only ever one batch being appended at a time, but
+	// roll back to the earliest marker just in case.
+	for i := len(found.batches) - 1; i >= 0; i-- {
+		if err = l.rollbackBatch(found.batches[i]); err != nil {
+			return err
+		}
+	}
+
+	l.discovered = nil
+	for _, orphan := range found.orphans {
+		l.discovered = append(l.discovered, orphan)
+	}
+	for _, gap := range l.gaps() {
+		l.discovered = append(l.discovered, gap)
+	}
+
+	l.linkSegments()
+
+	// Only the active segment is appended to, and a read-only log
+	// doesn't append to any. The writer may still truncate the
+	// active segment's store though, which a mapping of it wouldn't
+	// survive, so a read-only log seals it without mapping it.
+	for _, s := range l.segments {
+		if s != l.activeSegment {
+			err = s.seal()
+		} else if l.Config.ReadOnly {
+			err = s.store.seal()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Version 1 stores have no checksums, so rather than append more
+	// records without them, roll to a segment in the current version.
+	if s := l.activeSegment; !l.Config.ReadOnly && s.store.version == storeVersionLegacy {
+		if err = l.roll(s.nextOffset); err != nil {
+			return err
+		}
+	}
+
+	l.recovery = nil
+	for _, s := range l.segments {
+		if s.recovered.repaired() {
+			l.recovery = append(l.recovery, s.recovered)
+		}
+	}
+
 	return nil
 }
 
+// linkSegments sets each sealed segment's next offset to the next
+// segment's base offset. Compaction can remove the records at the end
+// of a sealed segment, so its index alone can't tell where it ends.
+func (l *Log) linkSegments() {
+	for i := 0; i < len(l.segments)-1; i++ {
+		l.segments[i].nextOffset = l.segments[i+1].baseOffset
+	}
+}
+
+// Recovery reports how each segment that needed it was repaired
+// when the log was opened, e.g. after the service crashed.
+func (l *Log) Recovery() []RecoveryReport {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.recovery
+}
+
 // Appends a record to the log. Append the record to the
 // active segment. Make a new active segment if the segment
 // is at its max size (per the max size configuration).
-func (l *Log) Append(record *api.Record) (uint64, error) {
+func (l *Log) Append(record *api.Record) (offset uint64, err error) {
+	start := l.metrics.appendSeconds.Start()
+	defer func() {
+		count(l.metrics.appends, l.metrics.appendErrors, 1, err)
+		l.metrics.appendSeconds.ObserveSince(start)
+	}()
+
+	if l.Config.Durability.GroupCommit.Enabled {
+		return l.groupAppend(record)
+	}
+
 	// RWMutex is used to grant access to reads when there
 	// isn't a write holding the lock.
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	offset, err := l.activeSegment.Append(record)
+	if err := l.checkOpen(); err != nil {
+		return 0, err
+	}
+	if err := l.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	offset, err = l.append(record)
 	if err != nil {
+		return offset, err
+	}
+
+	// Append only returns once the record is
+	// as durable as the config asks for.
+	if err = l.commit(); err != nil {
 		return 0, err
 	}
+	l.notify()
 
+	return offset, nil
+}
+
+// append writes the record to the active segment, counts it towards
+// the next sync and rolls to a new segment if the active one is
+// maxed. The caller must hold the write lock and commit the record.
+func (l *Log) append(record *api.Record) (uint64, error) {
+	// The active segment is still maxed if rolling
+	// it failed after the last append.
+	if s := l.activeSegment; s.IsMaxed() || s.IsExpired(time.Now()) {
+		if err := l.roll(s.nextOffset); err != nil {
+			return 0, err
+		}
+	}
+
+	size := l.activeSegment.store.size
+	offset, err := l.activeSegment.Append(record)
+	if errors.Is(err, ErrSegmentFull) {
+		// The index can fill up before the segment counts as maxed
+		// if its max size isn't a multiple of the entry width.
+		if err = l.roll(l.activeSegment.nextOffset); err != nil {
+			return 0, err
+		}
+		size = l.activeSegment.store.size
+		offset, err = l.activeSegment.Append(record)
+	}
+	if err != nil {
+		return 0, l.check(err)
+	}
+	l.unsyncedRecords++
+	l.unsyncedBytes += l.activeSegment.store.size - size
+
+	// The record is appended even if the new segment can't be
+	// opened, in which case the next append tries again.
 	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(offset + 1)
+		if err = l.roll(offset + 1); errors.Is(err, ErrFailed) {
+			return 0, err
+		}
 	}
 
-	return offset, err
+	return offset, nil
 }
 
-// Reads the record stored at the given offset.
-func (l *Log) Read(offset uint64) (*api.Record, error) {
+// Reads the record stored at the given offset. If compaction removed
+// it, Read returns the next record after it instead, so callers should
+// check the record's offset.
+func (l *Log) Read(offset uint64) (_ *api.Record, err error) {
+	start := l.metrics.readSeconds.Start()
+	defer func() {
+		count(l.metrics.reads, l.metrics.readErrors, 1, err)
+		l.metrics.readSeconds.ObserveSince(start)
+	}()
+
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	var s *segment
-	for _, segment := range l.segments {
-		// Since the segments are in order from oldest to newest and the
-		// segment's base offset is the smallest offset in the segment,
-		// we iterate over the segments until we find the first segment
-		// whose base offset is less than or equal to the offset we seek.
-		if segment.baseOffset <= offset && offset < segment.nextOffset {
-			s = segment
-			break
-		}
+	_, p, err := l.readRaw(offset)
+	if err != nil {
+		return nil, err
 	}
 
-	if s == nil || s.nextOffset <= offset {
-		return nil, fmt.Errorf("offset out of range: %d", offset)
+	// The bytes can be a view into a mapped store,
+	// so they're decoded while the lock is held.
+	record := &api.Record{}
+	err = proto.Unmarshal(p, record)
+
+	return record, err
+}
+
+// ReadRawFunc is Read without decoding the record, for callers that
+// pass records on as they are, e.g. to consumers. It calls fn with the
+// record's bytes, which decode as an api.Record, and returns the offset
+// of the record read, which is after the given one if compaction
+// removed it, along with fn's error.
+//
+// fn is called with the read lock held, so it mustn't call the log's
+// methods that write. The bytes can be shared with the record cache,
+// so they mustn't be modified. With Config.Segment.MapSealed, the bytes
+// of a record in a sealed segment are a view into the mapped store
+// instead of a copy, which retention, compaction and Truncate can unmap
+// once fn returns, so fn must copy any bytes it keeps.
+func (l *Log) ReadRawFunc(offset uint64, fn func(p []byte) error) (_ uint64, err error) {
+	start := l.metrics.readSeconds.Start()
+	defer func() {
+		count(l.metrics.reads, l.metrics.readErrors, 1, err)
+		l.metrics.readSeconds.ObserveSince(start)
+	}()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	read, p, err := l.readRaw(offset)
+	if err != nil {
+		return 0, err
+	}
+
+	return read, fn(p)
+}
+
+// readRaw reads the record stored at the given offset without
+// decoding it. The caller must hold the lock.
+func (l *Log) readRaw(offset uint64) (uint64, []byte, error) {
+	if err := l.checkOpen(); err != nil {
+		return 0, nil, err
+	}
+
+	if p, ok := l.cache.get(offset); ok {
+		return offset, p, nil
+	}
+
+	s := l.findSegment(offset)
+	if s == nil {
+		return 0, nil, l.outOfRange(offset)
 	}
 
 	// Once we know the segment that contains the record, we get the index
 	// entry from the segment's index and we read the data out of the
 	// segment's store file and return the data.
-	return s.Read(offset)
+	read, p, err := s.ReadRaw(offset)
+	// Compaction can remove the records at the end of a sealed
+	// segment, in which case the next record is in a later one.
+	for err == errEndOfSegment && s != l.activeSegment {
+		if s = l.findSegment(s.nextOffset); s == nil {
+			break
+		}
+		read, p, err = s.ReadRaw(s.baseOffset)
+	}
+	if err == errEndOfSegment || s == nil {
+		return 0, nil, l.outOfRange(offset)
+	}
+	if err == nil {
+		l.cache.add(read, p)
+	}
+
+	return read, p, err
+}
+
+// OffsetForTime returns the offset of the first record appended at
+// or after the given time, e.g. to replay the records since then.
+// If there's no such record, it returns the offset the next record
+// appended gets.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	for _, s := range l.segments {
+		// Every record in the segment was appended before t.
+		if s.lastAppended.Before(t) {
+			continue
+		}
+		offset, ok, err := s.offsetForTime(t)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return offset, nil
+		}
+	}
+
+	return l.activeSegment.nextOffset, nil
+}
+
+// Returns the segment holding the given offset, or nil if no
+// segment holds it. The caller must hold the lock.
+func (l *Log) findSegment(offset uint64) *segment {
+	// Most reads are of records appended not long ago, e.g. by
+	// consumers keeping up with the log, so try the active segment
+	// first. Nothing before it holds an offset past its base.
+	if s := l.activeSegment; s.baseOffset <= offset {
+		if offset < s.nextOffset {
+			return s
+		}
+		return nil
+	}
+
+	// Since the segments are in order from oldest to newest and the
+	// segment's base offset is the smallest offset in the segment,
+	// the segment holding the offset is the last one whose base
+	// offset is less than or equal to it.
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].baseOffset > offset
+	}) - 1
+	if i < 0 || offset >= l.segments[i].nextOffset {
+		return nil
+	}
+	return l.segments[i]
+}
+
+// Returns the error for reading an offset the log doesn't
+// have. The caller must hold the lock.
+func (l *Log) outOfRange(offset uint64) error {
+	err := &OffsetOutOfRangeError{Offset: offset}
+	if len(l.segments) > 0 {
+		err.Lowest = l.segments[0].baseOffset
+		err.Next = l.activeSegment.nextOffset
+	}
+	return err
+}
+
+// Returns ErrClosed once the log is closed. The
+// caller must hold the lock.
+func (l *Log) checkOpen() error {
+	if l.closing == nil {
+		return ErrClosed
+	}
+	return nil
 }
 
 // Iterate over the segments and closes them.
+// Closing a log that's already closed returns ErrClosed.
 func (l *Log) Close() error {
+	if !l.stopBackground() {
+		return ErrClosed
+	}
+
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	// Closing doesn't sync the store, so sync anything
+	// that's still waiting on the durability mode. A
+	// failed log has nothing it can trust to sync.
+	var err error
+	if l.Config.Durability.Mode != DurabilityOS && l.failed == nil {
+		err = l.sync()
+	}
+
+	// Close every segment and release the lock, even if
+	// closing one fails, so nothing is left open.
 	for _, segment := range l.segments {
-		if err := segment.Close(); err != nil {
-			return err
+		if serr := segment.Close(); err == nil {
+			err = serr
+		}
+	}
+	if l.lock != nil {
+		if lerr := l.lock.Close(); err == nil {
+			err = lerr
 		}
+		l.lock = nil
 	}
 
-	return nil
+	return err
 }
 
 // Closes the log and remove its data.
 func (l *Log) Remove() error {
-	if err := l.Close(); err != nil {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := l.Close(); err != nil && !errors.Is(err, ErrClosed) {
 		return err
 	}
-	return os.RemoveAll(l.Dir)
+	return l.backend.RemoveAll()
 }
 
 // Removes the log and creates a new log to replace it.
@@ -163,45 +557,88 @@ func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return err
 	}
-	return l.setup()
+	l.mu.Lock()
+	l.segments = nil
+	l.activeSegment = nil
+	l.failed = nil
+	l.mu.Unlock()
+	l.cache.clear()
+	return l.open()
 }
 
+// LowestOffset returns the offset of the oldest record the log has,
+// or would have, as the log's first offset.
 func (l *Log) LowestOffset() (uint64, error) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkSegments(); err != nil {
+		return 0, err
+	}
 	return l.segments[0].baseOffset, nil
 }
 
+// HighestOffset returns the offset of the newest record appended to
+// the log. A log with no offsets, e.g. a new one, returns ErrEmpty.
 func (l *Log) HighestOffset() (uint64, error) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
 
-	offset := l.segments[len(l.segments)-1].nextOffset
-	if offset == 0 {
-		return 0, nil
+	if err := l.checkSegments(); err != nil {
+		return 0, err
 	}
-	return offset - 1, nil
+	next := l.activeSegment.nextOffset
+	if next == l.segments[0].baseOffset {
+		return 0, ErrEmpty
+	}
+	return next - 1, nil
+}
+
+// checkSegments returns ErrClosed unless the log is open and has its
+// segments, which a log that failed to reset doesn't. The caller must
+// hold the lock.
+func (l *Log) checkSegments() error {
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	if len(l.segments) == 0 {
+		return ErrClosed
+	}
+	return nil
 }
 
 // Removes all segments whose highest offset is lower than
 // lowest. We don't have infinite disk space so we call
 // truncate periodically to remove old segments whose data
 // has hopefully been procssed by then and don't need anymore.
+// The active segment is still being appended to, so like with
+// retention it's kept even if lowest is past its records.
 func (l *Log) Truncate(lowest uint64) error {
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if err := l.checkOpen(); err != nil {
+		return err
+	}
+	if err := l.checkWritable(); err != nil {
+		return err
+	}
+
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
+		if s != l.activeSegment && s.nextOffset <= lowest+1 {
 			if err := s.Remove(); err != nil {
-				return err
+				return l.fail("remove segment", err)
 			}
+			l.cache.remove(s.baseOffset, s.nextOffset)
 			continue
 		}
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	l.metrics.truncations.Inc()
 	return nil
 }
 
@@ -209,14 +646,15 @@ func (l *Log) Truncate(lowest uint64) error {
 // This is used to concatenate the segments' stores.
 // The originReader type is needed to ensure we begin
 // reading from the origin of the store and read the
-// entire file.
+// entire file. The stores' file headers are skipped,
+// so what's read is the records' frames one after another.
 func (l *Log) Reader() io.Reader {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+		readers[i] = &originReader{segment.store, int64(segment.store.start())}
 	}
 	return io.MultiReader(readers...)
 }
@@ -227,14 +665,53 @@ func (o *originReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// Rolls to a new active segment once the current one is maxed.
+// Syncs only cover the active segment, so the old one is synced
+// first unless syncing is left to the operating system.
+func (l *Log) roll(offset uint64) error {
+	if l.Config.Durability.Mode != DurabilityOS {
+		if err := l.sync(); err != nil {
+			return err
+		}
+	}
+	sealed := l.activeSegment
+	if err := l.newSegment(offset); err != nil {
+		return err
+	}
+	l.metrics.rolls.Inc()
+	// Flushing the sealed segment's buffered records
+	// is a write, so failing to fails the log.
+	if err := sealed.seal(); err != nil {
+		return l.fail("write", err)
+	}
+	return nil
+}
+
+// rollOnAge is run in the background with a segment max age, so a
+// segment that's no longer appended to is still rolled once it's
+// expired. If rolling fails, the next append or check tries again.
+func (l *Log) rollOnAge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.failed != nil || !l.activeSegment.IsExpired(time.Now()) {
+		return
+	}
+	l.roll(l.activeSegment.nextOffset)
+}
+
 // Creates a new segment, appends that segment to the
 // log's slice of segments and make the new segment the
 // active segment so that subsequent append calls write to it.
 func (l *Log) newSegment(offset uint64) error {
-	s, err := newSegment(l.Dir, offset, l.Config)
+	s, err := newSegment(l.backend, offset, l.Config, l.metrics)
 	if err != nil {
 		return err
 	}
+	// Keep append times going forward across segments.
+	if l.activeSegment != nil && s.lastAppended.Before(l.activeSegment.lastAppended) {
+		s.lastAppended = l.activeSegment.lastAppended
+	}
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
 	return nil
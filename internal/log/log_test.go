@@ -1,22 +1,34 @@
 package log
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
-	api "github.com/jimxshaw/loglib/api/v1"
+	api "github.com/jimxshaw/loglib/api/v2"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestLog(t *testing.T) {
 	for scenario, fn := range map[string]func(t *testing.T, log *Log){
-		"append and read a record succeeds": testAppendRead,
-		"offset out of range error":         testOutOfRangeErr,
-		"init with existing segments":       testInitExisting,
-		"reader":                            testReader,
-		"truncate":                          testTruncate,
+		"append and read a record succeeds":    testAppendRead,
+		"offset out of range error":            testOutOfRangeErr,
+		"init with existing segments":          testInitExisting,
+		"empty log has no highest offset":      testEmptyOffsets,
+		"reader":                               testReader,
+		"truncate":                             testTruncate,
+		"truncate everything keeps the active": testTruncateAll,
+		"closed log errors":                    testClosedErr,
+		"v2 record fields are kept":            testRecordFields,
+		"another log is locked out":            testLocked,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -28,6 +40,7 @@ func TestLog(t *testing.T) {
 
 			log, err := NewLog(dir, c)
 			require.NoError(t, err)
+			defer log.Close()
 
 			fn(t, log)
 		})
@@ -50,7 +63,11 @@ func testAppendRead(t *testing.T, log *Log) {
 func testOutOfRangeErr(t *testing.T, log *Log) {
 	read, err := log.Read(1)
 	require.Nil(t, read)
-	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrOffsetOutOfRange))
+
+	var outOfRange *OffsetOutOfRangeError
+	require.True(t, errors.As(err, &outOfRange))
+	require.Equal(t, OffsetOutOfRangeError{Offset: 1}, *outOfRange)
 }
 
 func testInitExisting(t *testing.T, o *Log) {
@@ -64,24 +81,61 @@ func testInitExisting(t *testing.T, o *Log) {
 	}
 	require.NoError(t, o.Close())
 
-	offset, err := o.LowestOffset()
+	_, err := o.LowestOffset()
+	require.Equal(t, ErrClosed, err)
+	_, err = o.HighestOffset()
+	require.Equal(t, ErrClosed, err)
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	defer n.Close()
+
+	offset, err := n.LowestOffset()
 	require.NoError(t, err)
 	require.Equal(t, uint64(0), offset)
 
-	offset, err = o.HighestOffset()
+	offset, err = n.HighestOffset()
 	require.NoError(t, err)
 	require.Equal(t, uint64(2), offset)
+}
 
-	n, err := NewLog(o.Dir, o.Config)
+func testEmptyOffsets(t *testing.T, log *Log) {
+	offset, err := log.LowestOffset()
 	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+	_, err = log.HighestOffset()
+	require.Equal(t, ErrEmpty, err)
 
-	offset, err = n.LowestOffset()
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	offset, err = log.HighestOffset()
 	require.NoError(t, err)
 	require.Equal(t, uint64(0), offset)
 
-	offset, err = n.HighestOffset()
+	// Truncating every record leaves no offsets either.
+	require.NoError(t, log.Truncate(0))
+	offset, err = log.LowestOffset()
 	require.NoError(t, err)
-	require.Equal(t, uint64(2), offset)
+	require.Equal(t, uint64(1), offset)
+	_, err = log.HighestOffset()
+	require.Equal(t, ErrEmpty, err)
+}
+
+// A log that fails to reset is left without segments
+// and reports itself closed.
+func TestOffsetsAfterFailedReset(t *testing.T) {
+	b := NewFaultBackend(NewMemoryBackend())
+	log, err := NewLogWithBackend(b, Config{})
+	require.NoError(t, err)
+	appendRecords(t, log, 1)
+
+	b.Inject(Fault{Op: OpOpen, Ext: storeExt, Err: syscall.EIO})
+	require.ErrorIs(t, log.Reset(), syscall.EIO)
+
+	_, err = log.LowestOffset()
+	require.Equal(t, ErrClosed, err)
+	_, err = log.HighestOffset()
+	require.Equal(t, ErrClosed, err)
 }
 
 func testReader(t *testing.T, log *Log) {
@@ -97,7 +151,7 @@ func testReader(t *testing.T, log *Log) {
 	require.NoError(t, err)
 
 	read := &api.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read)
+	err = proto.Unmarshal(b[headerWidth:], read)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
 }
@@ -118,3 +172,610 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+// Truncating past every record removes the sealed segments but
+// keeps the active one, so the log can still be read and appended to.
+func testTruncateAll(t *testing.T, log *Log) {
+	// Each record fills a segment, so 0 to 2 are
+	// sealed and 3 is active and empty.
+	appendRecords(t, log, 3)
+	require.NoError(t, log.Truncate(10))
+	require.Equal(t, []uint64{3}, baseOffsets(log))
+
+	for _, offset := range []uint64{0, 5} {
+		_, err := log.Read(offset)
+		var outOfRange *OffsetOutOfRangeError
+		require.True(t, errors.As(err, &outOfRange))
+		require.Equal(t, OffsetOutOfRangeError{Offset: offset, Lowest: 3, Next: 3}, *outOfRange)
+	}
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	read, err := log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), read.Offset)
+}
+
+// An index whose max size isn't a multiple of the entry width fills
+// up before the segment counts as maxed, so appending has to roll.
+func TestIndexFullRolls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index-full-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth*2 + 4
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := uint64(0); i < 3; i++ {
+		offset, err := log.Append(&api.Record{Value: []byte("hi")})
+		require.NoError(t, err)
+		require.Equal(t, i, offset)
+	}
+	require.Len(t, log.segments, 2)
+}
+
+// scanSegment finds the segment holding the offset the way
+// findSegment used to, by checking every segment in turn.
+func scanSegment(log *Log, offset uint64) *segment {
+	for _, s := range log.segments {
+		if s.baseOffset <= offset && offset < s.nextOffset {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestFindSegment(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 2
+	log, err := NewLogWithBackend(NewMemoryBackend(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// Segments 2 and 4 are sealed and 6 is active,
+	// after segment 0 is truncated away.
+	appendRecords(t, log, 7)
+	require.NoError(t, log.Truncate(1))
+	require.Len(t, log.segments, 3)
+
+	for offset := uint64(0); offset < 10; offset++ {
+		require.Equal(t, scanSegment(log, offset), log.findSegment(offset), "offset %d", offset)
+	}
+	require.Nil(t, log.findSegment(1))
+	require.Equal(t, log.activeSegment, log.findSegment(6))
+	require.Nil(t, log.findSegment(7))
+}
+
+// sealed returns whether each of the log's segments is sealed.
+func sealed(log *Log) []bool {
+	var sealed []bool
+	for _, s := range log.segments {
+		sealed = append(sealed, s.store.isSealed())
+	}
+	return sealed
+}
+
+func TestSealed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sealed-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// Segments 0 and 2 are sealed and 4 is active.
+	appendRecords(t, log, 5)
+	require.Equal(t, []bool{true, true, false}, sealed(log))
+
+	// Sealed segments are read without taking their store's lock.
+	// The readers send back what went wrong, since only the
+	// test's goroutine can fail it.
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for offset := uint64(0); offset < 4; offset++ {
+				read, err := log.Read(offset)
+				if err == nil && read.Offset != offset {
+					err = fmt.Errorf("read offset %d at %d", read.Offset, offset)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	appendRecords(t, log, 1)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, []bool{true, true, true, false}, sealed(log))
+
+	// Rolling back a batch removes the empty active segment,
+	// making the one before it active again.
+	require.NoError(t, log.rollback(5))
+	require.Equal(t, []bool{true, true, false}, sealed(log))
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	read, err := log.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), read.Offset)
+	require.Equal(t, []bool{true, true, true, false}, sealed(log))
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true, true, false}, sealed(log))
+	require.NoError(t, log.Close())
+
+	log, err = OpenReadOnly(dir)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true, true, true}, sealed(log))
+	require.NoError(t, log.Close())
+}
+
+func TestMapSealed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "map-sealed-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth * 2
+	c.Segment.MapSealed = true
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// Segments 0 and 2 are sealed and 4 is active.
+	appendRecords(t, log, 5)
+	mapped := func(log *Log) []bool {
+		var mapped []bool
+		for _, s := range log.segments {
+			mapped = append(mapped, s.store.mapping != nil)
+		}
+		return mapped
+	}
+	require.Equal(t, []bool{true, true, false}, mapped(log))
+
+	for offset := uint64(0); offset < 5; offset++ {
+		record := &api.Record{}
+		read, err := log.ReadRawFunc(offset, func(p []byte) error {
+			return proto.Unmarshal(p, record)
+		})
+		require.NoError(t, err)
+		require.Equal(t, offset, read)
+		require.Equal(t, offset, record.Offset)
+		require.Equal(t, []byte("hello world"), record.Value)
+	}
+	_, err = log.ReadRawFunc(5, func([]byte) error { return nil })
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+	// fn's error is passed back.
+	errStop := errors.New("stop")
+	_, err = log.ReadRawFunc(0, func([]byte) error { return errStop })
+	require.Equal(t, errStop, err)
+	require.NoError(t, log.Close())
+
+	// The active segment's store isn't mapped by a read-only
+	// log, since the writer can still truncate it.
+	c.ReadOnly = true
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true, false}, mapped(log))
+	read, err := log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), read.Offset)
+	require.NoError(t, log.Close())
+}
+
+func testClosedErr(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrClosed, err)
+	_, err = log.Read(0)
+	require.Equal(t, ErrClosed, err)
+	require.Equal(t, ErrClosed, log.Truncate(0))
+	require.Equal(t, ErrClosed, log.Close())
+}
+
+func testLocked(t *testing.T, log *Log) {
+	_, err := NewLog(log.Dir, log.Config)
+	require.ErrorIs(t, err, ErrLocked)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+}
+
+func TestRollOnAgeAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll-on-age-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxAge = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// An empty segment has no age, however long it's been open.
+	require.False(t, log.activeSegment.IsExpired(time.Now().Add(2*time.Hour)))
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	log.activeSegment.firstAppended = time.Now().Add(-2 * time.Hour)
+
+	offset, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), offset)
+	require.Len(t, log.segments, 2)
+	require.Equal(t, uint64(1), log.activeSegment.baseOffset)
+}
+
+func TestRollOnAgeBackground(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll-on-age-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxAge = 200 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// Append part of the way through a max age, so the segment
+	// expires between checks made every max age.
+	time.Sleep(c.Segment.MaxAge / 2)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	appended := time.Now()
+
+	require.Eventually(t, func() bool {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+		return log.activeSegment.baseOffset == 1
+	}, time.Second, time.Millisecond)
+	// The segment rolls soon after it expires, rather than
+	// at the first check a whole max age after that.
+	require.Less(t, time.Since(appended), c.Segment.MaxAge*5/4)
+
+	// Only segments with records roll, so the
+	// new, empty active segment stays put.
+	time.Sleep(c.Segment.MaxAge)
+	require.Equal(t, []uint64{0, 1}, baseOffsets(log))
+}
+
+func TestOffsetForTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offset-for-time-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Several records to a segment and a time index entry for only
+	// some of them, so lookups have to read on from the entries.
+	c := Config{}
+	c.Segment.MaxStoreBytes = 256
+	c.Segment.TimeIndexBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	var times []time.Time
+	for i := 0; i < 20; i++ {
+		off, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		times = append(times, record.AppendTime.AsTime())
+		// Make sure records don't share append times.
+		time.Sleep(time.Microsecond)
+	}
+	require.Greater(t, len(log.segments), 2)
+	require.Less(t, len(log.segments[0].timeIndex.entries), 5)
+
+	check := func(log *Log) {
+		for i, at := range times {
+			off, err := log.OffsetForTime(at)
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), off)
+
+			// Just after a record's append time is the next record.
+			off, err = log.OffsetForTime(at.Add(time.Nanosecond))
+			require.NoError(t, err)
+			require.Equal(t, uint64(i+1), off)
+		}
+
+		off, err := log.OffsetForTime(times[0].Add(-time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+	}
+	check(log)
+
+	// Append times and the time index are kept across restarts.
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	check(log)
+
+	// Append times keep going forward.
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	record, err := log.Read(off)
+	require.NoError(t, err)
+	require.False(t, record.AppendTime.AsTime().Before(times[len(times)-1]))
+}
+
+func testRecordFields(t *testing.T, log *Log) {
+	produced := timestamppb.New(time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC))
+	want := &api.Record{
+		Value: []byte(`{"name":"gopher"}`),
+		Key:   []byte("user-1"),
+		Headers: []*api.Header{
+			{Key: "trace", Value: []byte("abc")},
+			{Key: "trace", Value: []byte("def")},
+		},
+		ProducerTime: produced,
+		ContentType:  "application/json",
+	}
+	off, err := log.Append(want)
+	require.NoError(t, err)
+
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, want.Key, read.Key)
+	require.Equal(t, want.Value, read.Value)
+	require.Equal(t, want.ContentType, read.ContentType)
+	require.Len(t, read.Headers, 2)
+	for i, h := range want.Headers {
+		require.True(t, proto.Equal(h, read.Headers[i]))
+	}
+	require.True(t, proto.Equal(produced, read.ProducerTime))
+	require.NotNil(t, read.AppendTime)
+}
+
+// testdata/v1 holds a log written before stores had headers and
+// checksums: segment 0 is sealed with records 0 to 3, and segment
+// 4 is active with record 4. The records are v1 records.
+// copyTestdata copies the log in the given directory of testdata
+// to a temporary directory, which it returns, so it can be written.
+func copyTestdata(t *testing.T, name string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", name+"-log-test")
+	require.NoError(t, err)
+	names, err := filepath.Glob(filepath.Join("testdata", name, "*"))
+	require.NoError(t, err)
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, filepath.Base(name)), b, 0644))
+	}
+	return dir
+}
+
+func TestOpenV1Log(t *testing.T) {
+	dir := copyTestdata(t, "v1")
+	defer os.RemoveAll(dir)
+
+	check := func(log *Log) {
+		for i := uint64(0); i < 5; i++ {
+			read, err := log.Read(i)
+			require.NoError(t, err)
+			require.Equal(t, i, read.Offset)
+			require.Equal(t, fmt.Sprintf("record %d", i), string(read.Value))
+			require.Nil(t, read.AppendTime)
+		}
+	}
+
+	log, err := OpenReadOnly(dir)
+	require.NoError(t, err)
+	check(log)
+	require.NoError(t, log.Close())
+
+	// The old stores are kept as they are, and new records go
+	// to a new segment in the current format.
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, log.Recovery())
+	require.Empty(t, log.Discovery())
+	check(log)
+	require.Equal(t, []uint64{0, 4, 5}, baseOffsets(log))
+	off, err := log.Append(&api.Record{Value: []byte("record 5")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	check(log)
+	read, err := log.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, "record 5", string(read.Value))
+	require.NotNil(t, read.AppendTime)
+	require.Equal(t, []uint32{storeVersionLegacy, storeVersionLegacy, storeVersionCurrent}, []uint32{
+		log.segments[0].store.version,
+		log.segments[1].store.version,
+		log.segments[2].store.version,
+	})
+}
+
+// Version 2 stores have checksums but a shorter header,
+// and they're read and appended to as they are.
+func TestOpenV2Log(t *testing.T) {
+	dir := copyTestdata(t, "v2")
+	defer os.RemoveAll(dir)
+
+	check := func(log *Log, n uint64) {
+		for i := uint64(0); i < n; i++ {
+			read, err := log.Read(i)
+			require.NoError(t, err)
+			require.Equal(t, i, read.Offset)
+			require.Equal(t, fmt.Sprintf("record %d", i), string(read.Value))
+			require.NotNil(t, read.AppendTime)
+		}
+	}
+
+	log, err := OpenReadOnly(dir)
+	require.NoError(t, err)
+	check(log, 5)
+	require.NoError(t, log.Close())
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, log.Recovery())
+	require.Empty(t, log.Discovery())
+	require.Equal(t, []uint64{0, 4}, baseOffsets(log))
+	check(log, 5)
+	off, err := log.Append(&api.Record{Value: []byte("record 5")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Empty(t, log.Recovery())
+	check(log, 6)
+	for _, s := range log.segments {
+		require.Equal(t, uint32(storeVersionChecksums), s.store.version)
+	}
+}
+
+// A store whose header names a version the log doesn't
+// know keeps the log from opening.
+func TestOpenUnsupportedFormat(t *testing.T) {
+	b := NewMemoryBackend()
+	f, err := b.Open(segmentFile(0, storeExt))
+	require.NoError(t, err)
+	_, err = f.WriteAt(append([]byte("LOGS"), 0, 0, 0, 9), 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = NewLogWithBackend(b, Config{})
+	require.ErrorIs(t, err, ErrUnsupportedFormat)
+	var format *UnsupportedFormatError
+	require.True(t, errors.As(err, &format))
+	require.Equal(t, UnsupportedFormatError{Version: 9}, *format)
+}
+
+// benchmarkLog returns a log on the memory backend with a
+// record in each of the given number of segments.
+func benchmarkLog(b *testing.B, segments int) *Log {
+	b.Helper()
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entryWidth
+	log, err := NewLogWithBackend(NewMemoryBackend(), c)
+	require.NoError(b, err)
+	b.Cleanup(func() { log.Close() })
+
+	record := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < segments; i++ {
+		_, err = log.Append(record)
+		require.NoError(b, err)
+	}
+	return log
+}
+
+// Looking up segments spread across the log, with
+// the old linear scan for comparison.
+func BenchmarkFindSegment(b *testing.B) {
+	for _, segments := range []int{100, 10000} {
+		log := benchmarkLog(b, segments)
+		for name, find := range map[string]func(uint64) *segment{
+			"scan":   func(offset uint64) *segment { return scanSegment(log, offset) },
+			"search": log.findSegment,
+		} {
+			b.Run(fmt.Sprintf("%s/%d", name, segments), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if find(uint64(i%segments)) == nil {
+						b.Fatal("no segment")
+					}
+				}
+			})
+		}
+	}
+}
+
+// Reading the oldest record, in the first segment, and the
+// newest one, in the segment before the active one.
+func BenchmarkRead(b *testing.B) {
+	log := benchmarkLog(b, 10000)
+	for name, offset := range map[string]uint64{
+		"oldest": 0,
+		"newest": 9999,
+	} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := log.Read(offset); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		// Readers of sealed segments don't wait on each other.
+		b.Run(name+"/parallel", func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := log.Read(offset); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// Reading records spread across a log's sealed segments,
+// from the files and from the mapped stores.
+func BenchmarkReadMapped(b *testing.B) {
+	for name, mapSealed := range map[string]bool{
+		"file":   false,
+		"mapped": true,
+	} {
+		dir, err := ioutil.TempDir("", "read-mapped-bench")
+		require.NoError(b, err)
+		defer os.RemoveAll(dir)
+
+		c := Config{}
+		c.Segment.MaxIndexBytes = entryWidth * 100
+		c.Segment.MapSealed = mapSealed
+		log, err := NewLog(dir, c)
+		require.NoError(b, err)
+		defer log.Close()
+		appendRecords(b, log, 1000)
+
+		b.Run("Read/"+name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := log.Read(uint64(i % 900)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run("ReadRawFunc/"+name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := log.ReadRawFunc(uint64(i%900), func([]byte) error { return nil }); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package log
+
+import (
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// NewMemoryBackend returns a backend that keeps the log's files in
+// memory. They're lost when the process exits, and syncing does
+// nothing.
+func NewMemoryBackend() Backend {
+	return &memoryBackend{files: make(map[string]*memoryData)}
+}
+
+type memoryBackend struct {
+	mu     sync.Mutex
+	files  map[string]*memoryData
+	locked bool
+}
+
+func (b *memoryBackend) List() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var names []string
+	for name := range b.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (b *memoryBackend) Open(name string) (File, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d, ok := b.files[name]
+	if !ok {
+		d = &memoryData{name: name, modTime: time.Now()}
+		b.files[name] = d
+	}
+	return &memoryFile{memoryData: d}, nil
+}
+
+func (b *memoryBackend) OpenReadOnly(name string) (File, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d, ok := b.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &memoryFile{memoryData: d, readOnly: true}, nil
+}
+
+// Map returns the file's contents, which writes to the mapping change
+// directly, the same as they would a file mapped by the operating system.
+func (b *memoryBackend) Map(f File) (Mapping, error) {
+	m := f.(*memoryFile)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return memoryMapping(m.data), nil
+}
+
+// MapReadOnly returns the file's contents, the same as Map. Nothing
+// stops them being written to, so it's up to the caller not to.
+func (b *memoryBackend) MapReadOnly(f File) (Mapping, error) {
+	return b.Map(f)
+}
+
+func (b *memoryBackend) Remove(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(b.files, name)
+	return nil
+}
+
+func (b *memoryBackend) Rename(oldname, newname string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d, ok := b.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	delete(b.files, oldname)
+	d.mu.Lock()
+	d.name = newname
+	d.mu.Unlock()
+	b.files[newname] = d
+	return nil
+}
+
+func (b *memoryBackend) Sync() error {
+	return nil
+}
+
+func (b *memoryBackend) RemoveAll() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.files = make(map[string]*memoryData)
+	return nil
+}
+
+func (b *memoryBackend) Lock() (io.Closer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.locked {
+		return nil, ErrLocked
+	}
+	b.locked = true
+	return &memoryLock{backend: b}, nil
+}
+
+// memoryLock releases a memoryBackend's lock when it's closed.
+type memoryLock struct {
+	backend *memoryBackend
+	once    sync.Once
+}
+
+func (l *memoryLock) Close() error {
+	l.once.Do(func() {
+		l.backend.mu.Lock()
+		l.backend.locked = false
+		l.backend.mu.Unlock()
+	})
+	return nil
+}
+
+// memoryData is the contents of a file kept in memory.
+type memoryData struct {
+	mu      sync.Mutex
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+// memoryFile is an open memoryData. The data stays in the backend when
+// the file is closed, to be opened again.
+type memoryFile struct {
+	*memoryData
+	closed   bool
+	readOnly bool
+}
+
+func (f *memoryFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memoryFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.readOnly {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrPermission}
+	}
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.grow(end)
+	}
+	n := copy(f.data[off:], p)
+	f.modTime = time.Now()
+	return n, nil
+}
+
+func (f *memoryFile) Name() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.name
+}
+
+func (f *memoryFile) Stat() (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	return fileInfo{name: f.name, size: int64(len(f.data)), modTime: f.modTime}, nil
+}
+
+func (f *memoryFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.readOnly {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: os.ErrPermission}
+	}
+	if size > int64(len(f.data)) {
+		f.grow(size)
+	} else {
+		f.data = f.data[:size]
+	}
+	f.modTime = time.Now()
+	return nil
+}
+
+// grow extends the file with zeros to the given size. The caller
+// must hold the lock.
+func (f *memoryFile) grow(size int64) {
+	data := make([]byte, size)
+	copy(data, f.data)
+	f.data = data
+}
+
+func (f *memoryFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memoryFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+type memoryMapping []byte
+
+func (m memoryMapping) Bytes() []byte {
+	return m
+}
+
+func (m memoryMapping) Sync() error {
+	return nil
+}
+
+func (m memoryMapping) Unmap() error {
+	return nil
+}
@@ -0,0 +1,98 @@
+package log
+
+import "github.com/jimxshaw/loglib/internal/metrics"
+
+// logMetrics are what the log and its segments, stores and indexes
+// report to Config.Metrics.Registry. Without a registry they're all
+// nil, and nil metrics count nothing.
+type logMetrics struct {
+	appends       *metrics.Counter
+	appendErrors  *metrics.Counter
+	appendSeconds *metrics.Histogram
+	reads         *metrics.Counter
+	readErrors    *metrics.Counter
+	readSeconds   *metrics.Histogram
+	rolls         *metrics.Counter
+	truncations   *metrics.Counter
+	failures      *metrics.Counter
+
+	// Reported by segments.
+	segmentsRemoved *metrics.Counter
+	indexRebuilds   *metrics.Counter
+	// Reported by stores.
+	storeWrittenBytes *metrics.Counter
+	storeReadBytes    *metrics.Counter
+	storeSyncs        *metrics.Counter
+	// Reported by indexes.
+	indexEntries *metrics.Counter
+	indexSyncs   *metrics.Counter
+}
+
+// noMetrics are the metrics of stores and indexes that aren't part
+// of a segment, e.g. in tests, until the segment sets theirs.
+var noMetrics = &logMetrics{}
+
+// newLogMetrics returns the metrics for the log with the given
+// config, registering them if they aren't already. Logs with the
+// same registry and labels share their metrics.
+func newLogMetrics(c Config) *logMetrics {
+	r, labels := c.Metrics.Registry, c.Metrics.Labels
+	if r == nil {
+		return noMetrics
+	}
+	return &logMetrics{
+		appends:       r.Counter("log_appends_total", "Records appended.", labels),
+		appendErrors:  r.Counter("log_append_errors_total", "Appends that failed.", labels),
+		appendSeconds: r.Histogram("log_append_duration_seconds", "How long Append and AppendBatch took, once per call.", labels, metrics.DefaultBuckets),
+		reads:         r.Counter("log_reads_total", "Records read.", labels),
+		readErrors:    r.Counter("log_read_errors_total", "Reads that failed, including of offsets out of range.", labels),
+		readSeconds:   r.Histogram("log_read_duration_seconds", "How long Read and ReadRawFunc took.", labels, metrics.DefaultBuckets),
+		rolls:         r.Counter("log_segment_rolls_total", "New active segments rolled to.", labels),
+		truncations:   r.Counter("log_truncations_total", "Calls to Truncate that succeeded.", labels),
+		failures:      r.Counter("log_failures_total", "Times writing to storage failed the log.", labels),
+
+		segmentsRemoved: r.Counter("log_segments_removed_total", "Segments removed by truncation, retention or rollback.", labels),
+		indexRebuilds:   r.Counter("log_index_rebuilds_total", "Indexes rebuilt from their store.", labels),
+
+		storeWrittenBytes: r.Counter("log_store_written_bytes_total", "Bytes appended to stores, including record headers.", labels),
+		storeReadBytes:    r.Counter("log_store_read_bytes_total", "Bytes of records read from stores.", labels),
+		storeSyncs:        r.Counter("log_store_syncs_total", "Stores synced to stable storage.", labels),
+
+		indexEntries: r.Counter("log_index_entries_written_total", "Index entries written.", labels),
+		indexSyncs:   r.Counter("log_index_syncs_total", "Indexes synced to stable storage.", labels),
+	}
+}
+
+// registerGauges registers the gauges that are read off the log when
+// the metrics are written out. A log opened again with the same
+// registry and labels replaces them.
+func (l *Log) registerGauges() {
+	r, labels := l.Config.Metrics.Registry, l.Config.Metrics.Labels
+	if r == nil {
+		return
+	}
+	r.GaugeFunc("log_segments", "Segments in the log.", labels, func() float64 {
+		l.mu.RLock()
+		defer l.mu.RUnlock()
+		return float64(len(l.segments))
+	})
+	r.GaugeFunc("log_size_bytes", "Bytes the log's stores and indexes take up.", labels, func() float64 {
+		l.mu.RLock()
+		defer l.mu.RUnlock()
+		var size uint64
+		for _, s := range l.segments {
+			size += s.size()
+		}
+		return float64(size)
+	})
+}
+
+// count counts an operation on n records as done, or failed if err
+// isn't nil.
+func count(done, failed *metrics.Counter, n uint64, err error) {
+	if err != nil {
+		failed.Inc()
+		return
+	}
+	done.Add(n)
+}
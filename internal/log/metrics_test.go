@@ -0,0 +1,178 @@
+package log
+
+import (
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+	"github.com/jimxshaw/loglib/internal/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, r *metrics.Registry, c Config){
+		"appends and reads are counted":    testMetricsCounted,
+		"gauges are read off the log":      testMetricsGauges,
+		"gauges are read while resetting":  testMetricsGaugesReset,
+		"failing the log is counted":       testMetricsFailed,
+		"reopened log keeps counting":      testMetricsReopen,
+		"log without a registry is silent": testMetricsOff,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			// Two records to a segment.
+			c := Config{}
+			c.Segment.MaxIndexBytes = entryWidth * 2
+			c.Metrics.Registry = metrics.NewRegistry()
+			c.Metrics.Labels = metrics.Labels{"topic": "orders"}
+
+			fn(t, c.Metrics.Registry, c)
+		})
+	}
+}
+
+// counter returns the value of the log's counter with the given name.
+func counter(r *metrics.Registry, c Config, name string) uint64 {
+	return r.Counter(name, "", c.Metrics.Labels).Value()
+}
+
+func testMetricsCounted(t *testing.T, r *metrics.Registry, c Config) {
+	log, err := NewLogWithBackend(NewMemoryBackend(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// Segments 0, 2 and 4, and an empty 6 that's active.
+	appendRecords(t, log, 5)
+	_, _, err = log.AppendBatch(batchOf(1))
+	require.NoError(t, err)
+	for _, offset := range []uint64{0, 5} {
+		_, err = log.Read(offset)
+		require.NoError(t, err)
+	}
+	_, err = log.ReadRawFunc(1, func([]byte) error { return nil })
+	require.NoError(t, err)
+	_, err = log.Read(6)
+	require.Error(t, err)
+	require.NoError(t, log.Truncate(1))
+
+	for name, want := range map[string]uint64{
+		"log_appends_total":               6,
+		"log_append_errors_total":         0,
+		"log_reads_total":                 3,
+		"log_read_errors_total":           1,
+		"log_segment_rolls_total":         3,
+		"log_truncations_total":           1,
+		"log_segments_removed_total":      1,
+		"log_index_entries_written_total": 6,
+	} {
+		require.Equal(t, want, counter(r, c, name), name)
+	}
+	require.NotZero(t, counter(r, c, "log_store_written_bytes_total"))
+	require.NotZero(t, counter(r, c, "log_store_read_bytes_total"))
+
+	appendSeconds := r.Histogram("log_append_duration_seconds", "", c.Metrics.Labels, nil)
+	// The batch is timed once, not once per record.
+	require.Equal(t, uint64(6), appendSeconds.Count())
+	readSeconds := r.Histogram("log_read_duration_seconds", "", c.Metrics.Labels, nil)
+	require.Equal(t, uint64(4), readSeconds.Count())
+}
+
+func testMetricsGauges(t *testing.T, r *metrics.Registry, c Config) {
+	log, err := NewLogWithBackend(NewMemoryBackend(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendRecords(t, log, 3)
+
+	var b strings.Builder
+	_, err = r.WriteTo(&b)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "# TYPE log_segments gauge\nlog_segments{topic=\"orders\"} 2\n")
+	require.Contains(t, b.String(), "log_appends_total{topic=\"orders\"} 3\n")
+	require.Contains(t, b.String(), "log_append_duration_seconds_count{topic=\"orders\"} 3\n")
+	require.Contains(t, b.String(), "log_size_bytes{topic=\"orders\"} ")
+}
+
+func testMetricsGaugesReset(t *testing.T, r *metrics.Registry, c Config) {
+	log, err := NewLogWithBackend(NewMemoryBackend(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// Read the gauges over and over while the log is reset.
+	read := make(chan error, 1)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if _, err := r.WriteTo(ioutil.Discard); err != nil {
+				read <- err
+				return
+			}
+		}
+		read <- nil
+	}()
+	for reading := true; reading; {
+		select {
+		case err = <-read:
+			require.NoError(t, err)
+			reading = false
+		default:
+			appendRecords(t, log, 3)
+			require.NoError(t, log.Reset())
+		}
+	}
+
+	var b strings.Builder
+	_, err = r.WriteTo(&b)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "log_segments{topic=\"orders\"} 1\n")
+}
+
+func testMetricsFailed(t *testing.T, r *metrics.Registry, c Config) {
+	b := NewFaultBackend(NewMemoryBackend())
+	c.Durability.Mode = DurabilityAlways
+	log, err := NewLogWithBackend(b, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendRecords(t, log, 1)
+	require.Equal(t, uint64(1), counter(r, c, "log_store_syncs_total"))
+	require.Equal(t, uint64(1), counter(r, c, "log_index_syncs_total"))
+
+	b.Inject(Fault{Op: OpSync, Ext: storeExt, Err: syscall.EIO})
+	for i := 0; i < 2; i++ {
+		_, err = log.Append(&api.Record{Value: write})
+		require.ErrorIs(t, err, ErrFailed)
+	}
+	require.Equal(t, uint64(1), counter(r, c, "log_failures_total"))
+	require.Equal(t, uint64(2), counter(r, c, "log_append_errors_total"))
+}
+
+// The crashed log's index is rebuilt when it's opened again,
+// and it's counted along with what the log did before.
+func testMetricsReopen(t *testing.T, r *metrics.Registry, c Config) {
+	b := NewMemoryBackend()
+	log, err := NewLogWithBackend(b, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 1)
+	crash(t, log)
+
+	log, err = NewLogWithBackend(b, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, uint64(1), counter(r, c, "log_index_rebuilds_total"))
+	appendRecords(t, log, 1)
+	require.Equal(t, uint64(2), counter(r, c, "log_appends_total"))
+}
+
+func testMetricsOff(t *testing.T, r *metrics.Registry, c Config) {
+	c.Metrics.Registry = nil
+	log, err := NewLogWithBackend(NewMemoryBackend(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendRecords(t, log, 3)
+	_, err = log.Read(0)
+	require.NoError(t, err)
+
+	var b strings.Builder
+	_, err = r.WriteTo(&b)
+	require.NoError(t, err)
+	require.Empty(t, b.String())
+}
@@ -0,0 +1,35 @@
+package log
+
+/*
+	A read-only log is for looking at a log without changing it, e.g.
+	from a debugging tool or a follower, possibly while the service is
+	writing to it. It opens the files read only, maps the indexes
+	PROT_READ and never resizes, repairs or removes a file, so it
+	doesn't take the log's lock.
+
+	It doesn't take a shared lock either, though that would stop a
+	writer from opening the log while readers are looking at it. The
+	writer holds its lock for as long as it's open, and flock doesn't
+	give out a shared lock while an exclusive one is held, so a reader
+	taking one couldn't open a log that's being written to, which is
+	what followers are for. Nothing coordinates readers with the
+	writer instead: the writer only appends to, rolls, compacts and
+	removes files, which a reader's open files and mappings outlast,
+	so the reader goes on seeing the log as it was when it opened.
+
+	Whatever it would repair, it repairs in memory instead. The log
+	writing to the files buffers records and preallocates its indexes,
+	so the files can have index entries for records that aren't in
+	the store yet and half-written records at the end. A read-only log
+	sees the records that were whole in the files when it was opened,
+	with any unfinished batch rolled back. Reopen it to see newer ones.
+*/
+
+// OpenReadOnly opens the log kept in the given directory for reading
+// only. It takes no lock, not even a shared one, so it can be opened
+// next to the log writing to the directory, and a writer can open the
+// directory while it's open. Writes, such as Append, Truncate and
+// Reset, return ErrReadOnly.
+func OpenReadOnly(dir string) (*Log, error) {
+	return NewLog(dir, Config{ReadOnly: true})
+}
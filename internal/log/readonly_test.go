@@ -0,0 +1,132 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnly(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string, c Config){
+		"reads next to the writer":          testReadOnlyNextToWriter,
+		"crashed log is repaired in memory": testReadOnlyCrashed,
+		"unfinished batch is hidden":        testReadOnlyBatch,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "readonly-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+
+			fn(t, dir, c)
+		})
+	}
+}
+
+// files returns the size of each file in the directory.
+func files(t *testing.T, dir string) map[string]int64 {
+	t.Helper()
+
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	sizes := make(map[string]int64)
+	for _, info := range infos {
+		sizes[info.Name()] = info.Size()
+	}
+	return sizes
+}
+
+func testReadOnlyNextToWriter(t *testing.T, dir string, c Config) {
+	writer, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRecords(t, writer, 3)
+	// Reading flushes the records to the store's file, and
+	// the one appended after stays in the buffer.
+	_, err = writer.Read(2)
+	require.NoError(t, err)
+	appendRecords(t, writer, 1)
+	before := files(t, dir)
+
+	log, err := OpenReadOnly(dir)
+	require.NoError(t, err)
+	for offset := uint64(0); offset < 3; offset++ {
+		read, err := log.Read(offset)
+		require.NoError(t, err)
+		require.Equal(t, offset, read.Offset)
+	}
+	_, err = log.Read(3)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrReadOnly, err)
+	_, _, err = log.AppendBatch(batchOf(1))
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, log.Truncate(0))
+	require.Equal(t, ErrReadOnly, log.Reset())
+	require.NoError(t, log.Close())
+	require.Equal(t, before, files(t, dir))
+
+	appendRecords(t, writer, 1)
+	require.NoError(t, writer.Close())
+	writer, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer writer.Close()
+	require.Empty(t, writer.Recovery())
+	offset, err := writer.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), offset)
+}
+
+// As in testRecoverUnflushed, the crashed log's records never left
+// the store's buffer but their index entries are in the index file.
+func testReadOnlyCrashed(t *testing.T, dir string, c Config) {
+	crashed, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRecords(t, crashed, 3)
+	crash(t, crashed)
+	before := files(t, dir)
+
+	log, err := OpenReadOnly(dir)
+	require.NoError(t, err)
+	require.Equal(t, []RecoveryReport{{IndexEntries: 3}}, log.Recovery())
+	_, err = log.Read(0)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+	require.NoError(t, log.Close())
+	require.Equal(t, before, files(t, dir))
+
+	// The files are left for the writer to repair.
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, []RecoveryReport{{IndexEntries: 3}}, log.Recovery())
+}
+
+// The marker is put back after the batch, as if the
+// writer were still appending it.
+func testReadOnlyBatch(t *testing.T, dir string, c Config) {
+	writer, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer writer.Close()
+	appendRecords(t, writer, 1)
+	first, _, err := writer.AppendBatch(batchOf(3))
+	require.NoError(t, err)
+	marker := segmentFile(first, batchExt)
+	require.NoError(t, writer.createMarker(marker))
+
+	log, err := OpenReadOnly(dir)
+	require.NoError(t, err)
+	read, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), read.Offset)
+	_, err = log.Read(first)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+	require.NoError(t, log.Close())
+
+	require.Contains(t, files(t, dir), marker)
+}
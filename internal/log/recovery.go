@@ -0,0 +1,248 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// RecoveryReport describes how a segment was repaired when the log
+// was opened. A clean shutdown leaves nothing to repair, so no
+// reports are made.
+type RecoveryReport struct {
+	// Segment is the base offset of the repaired segment.
+	Segment uint64
+	// IndexEntries is the number of index entries dropped because
+	// they didn't match the records in the store. Zero-filled
+	// space past the last entry is preallocated and isn't counted.
+	IndexEntries uint64
+	// RebuiltEntries is the number of index entries written for
+	// records found in the store that the index was missing.
+	RebuiltEntries uint64
+	// StoreBytes is the number of bytes dropped from the end of
+	// the store, such as half-written records.
+	StoreBytes uint64
+	// RolledBack is the number of records dropped because they
+	// were part of a batch that didn't finish.
+	RolledBack uint64
+}
+
+func (r RecoveryReport) repaired() bool {
+	return r.IndexEntries != 0 || r.RebuiltEntries != 0 ||
+		r.StoreBytes != 0 || r.RolledBack != 0
+}
+
+/*
+	The store is the source of truth for a segment and the index is
+	just a faster way to find its records. So whenever the two disagree
+	the index is rebuilt by walking the length-prefixed records in the
+	store from the start, keeping the entries that already match and
+	writing the rest. The walk stops at the first record that's cut
+	short or fails its checksum.
+
+	They can disagree for a few reasons. The index file can be deleted
+	or damaged. If the service dies without closing the log then the
+	index file is never truncated back from its max size, so the space
+	past its last entry reads as entries full of zeros. Records still
+	sitting in the store's buffer never reach the file, so the index
+	can point past the end of the store. And a record can be
+	half-written when the buffer was flushed part of the way through
+	it.
+
+	Checking every record on every start would be slow, so a segment
+	is trusted when its index's last entry has the right relative
+	offset and points at a complete record that ends exactly where
+	the store ends.
+*/
+
+// consistent reports whether the index and store agree on
+// where the segment's last record is.
+func (s *segment) consistent() (bool, error) {
+	if s.index.size%entryWidth != 0 {
+		return false, nil
+	}
+	if s.index.size == 0 {
+		return s.store.size <= s.store.start(), nil
+	}
+
+	off, position, err := s.index.Read(-1)
+	if err != nil {
+		return false, err
+	}
+	// Compaction leaves gaps in offsets, so the last entry's relative
+	// offset can be past its slot but never before it. Zero-filled
+	// space past the real entries reads as relative offset 0.
+	if uint64(off) < s.index.size/entryWidth-1 {
+		return false, nil
+	}
+
+	p, err := s.store.Read(position)
+	if err != nil {
+		if isTornRecord(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return s.store.nextPosition(position, p) == s.store.size, nil
+}
+
+// rebuildIndex rewrites the index from the records in the store
+// and resets the segment's next offset to match. Anything in the
+// store after the last good record is cut off.
+func (s *segment) rebuildIndex() (RecoveryReport, error) {
+	report := RecoveryReport{Segment: s.baseOffset}
+	s.metrics.indexRebuilds.Inc()
+
+	// Records carry their offsets, which compaction can leave gaps
+	// between, so each record is decoded to get its relative offset.
+	var positions []uint64
+	var offsets []uint32
+	position := s.store.start()
+	for position < s.store.size {
+		p, err := s.store.Read(position)
+		if err != nil {
+			if isTornRecord(err) {
+				break
+			}
+			return report, err
+		}
+		record := &api.Record{}
+		if err = proto.Unmarshal(p, record); err != nil || !s.follows(offsets, record.Offset) {
+			break
+		}
+		positions = append(positions, position)
+		offsets = append(offsets, uint32(record.Offset-s.baseOffset))
+		position = s.store.nextPosition(position, p)
+	}
+
+	// Keep the entries at the start of the index that
+	// already point at the right records.
+	var kept uint64
+	for ; kept < uint64(len(positions)); kept++ {
+		off, position, err := s.index.Read(int64(kept))
+		if err != nil || off != offsets[kept] || position != positions[kept] {
+			break
+		}
+	}
+
+	if written := s.index.written(); written > kept {
+		report.IndexEntries = written - kept
+	}
+
+	// A read-only log can't write to the index's file,
+	// so the index is rebuilt in memory instead.
+	if s.index.readOnly && !s.index.detached {
+		if err := s.index.detach(uint64(len(positions))); err != nil {
+			return report, err
+		}
+	}
+	// The store can hold more records than the max index size has
+	// room for, e.g. if the max was lowered since it was written.
+	// The segment is then full and the log rolls past it.
+	if err := s.index.grow(s.backend, uint64(len(positions))); err != nil {
+		return report, err
+	}
+	s.index.Truncate(kept)
+
+	for i := kept; i < uint64(len(positions)); i++ {
+		if err := s.index.Write(offsets[i], positions[i]); err != nil {
+			return report, err
+		}
+		report.RebuiltEntries++
+	}
+
+	// Walking the store, as compaction and reading by time do, would
+	// find what's after the last good record corrupt, e.g. a record
+	// cut short by a crash, and not only in the active segment. A
+	// read-only log's store just stops reading at the good record.
+	if position < s.store.size {
+		report.StoreBytes = s.store.size - position
+		sealed := s.store.isSealed()
+		if err := s.store.Truncate(position); err != nil {
+			return report, err
+		}
+		// Truncating unsealed the store.
+		if sealed {
+			if err := s.seal(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	s.nextOffset = s.baseOffset
+	if n := len(offsets); n > 0 {
+		s.nextOffset += uint64(offsets[n-1]) + 1
+	}
+
+	return report, nil
+}
+
+// follows reports whether a record with the given offset can come
+// after the records with the given relative offsets in the segment.
+func (s *segment) follows(offsets []uint32, offset uint64) bool {
+	if offset < s.baseOffset {
+		return false
+	}
+	n := len(offsets)
+	return n == 0 || offset-s.baseOffset > uint64(offsets[n-1])
+}
+
+// trimStore cuts anything after the last indexed record from the
+// store, such as a record that was only partly written by a crash.
+func (s *segment) trimStore() (uint64, error) {
+	end := s.store.start()
+	if _, position, err := s.index.Read(-1); err == nil {
+		p, err := s.store.Read(position)
+		if err != nil {
+			return 0, err
+		}
+		end = s.store.nextPosition(position, p)
+	}
+
+	if s.store.size <= end {
+		return 0, nil
+	}
+	trimmed := s.store.size - end
+
+	return trimmed, s.store.Truncate(end)
+}
+
+// isTornRecord reports whether the error from reading a record
+// means it wasn't fully written, rather than the read itself failing.
+func isTornRecord(err error) bool {
+	return errors.Is(err, ErrCorrupt) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// RebuildIndex rewrites the index of the segment with the given base
+// offset from its store. Indexes are already rebuilt when the log is
+// opened if they disagree with their store; this is for operators who
+// suspect damage that check doesn't catch.
+func (l *Log) RebuildIndex(baseOffset uint64) (RecoveryReport, error) {
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkOpen(); err != nil {
+		return RecoveryReport{}, err
+	}
+	if err := l.checkWritable(); err != nil {
+		return RecoveryReport{}, err
+	}
+
+	for _, s := range l.segments {
+		if s.baseOffset == baseOffset {
+			report, err := s.rebuildIndex()
+			l.linkSegments()
+			return report, err
+		}
+	}
+
+	return RecoveryReport{}, fmt.Errorf("log: no segment with base offset %d", baseOffset)
+}
@@ -0,0 +1,293 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecovery(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string, c Config){
+		"clean shutdown reports nothing":          testRecoverClean,
+		"unflushed store drops index entries":     testRecoverUnflushed,
+		"half-written record is cut off":          testRecoverTornRecord,
+		"sealed segment's torn record is cut off": testRecoverTornSealed,
+		"index pointing past the store is fixed":  testRecoverShortStore,
+		"missing index is rebuilt from the store": testRecoverMissingIndex,
+		"lowered max index size keeps entries":    testRecoverLoweredMax,
+		"rebuild index on request":                testRebuildIndex,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "recovery-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+
+			fn(t, dir, c)
+		})
+	}
+}
+
+func appendRecords(t testing.TB, log *Log, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+}
+
+func testRecoverClean(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 3)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Empty(t, log.Recovery())
+
+	offset, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), offset)
+}
+
+// crash releases the log's lock without closing the log, the way
+// the operating system does when the process dies.
+func crash(t *testing.T, log *Log) {
+	t.Helper()
+	require.NoError(t, log.lock.Close())
+}
+
+// The first log is never closed, as if the service crashed, so its
+// records never leave the store's buffer but their index entries
+// are already in the memory-mapped file.
+func testRecoverUnflushed(t *testing.T, dir string, c Config) {
+	crashed, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRecords(t, crashed, 3)
+	crash(t, crashed)
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, []RecoveryReport{{IndexEntries: 3}}, log.Recovery())
+
+	offset, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+}
+
+func testRecoverTornRecord(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 3)
+	require.NoError(t, log.Close())
+
+	// Start a record whose length promises more bytes than
+	// made it to disk, and leave the index at its max size.
+	torn := make([]byte, headerWidth+4)
+	enc.PutUint64(torn, 100)
+	f, err := os.OpenFile(log.activeSegment.store.Name(), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(torn)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Truncate(log.activeSegment.index.Name(), int64(c.Segment.MaxIndexBytes)))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, []RecoveryReport{{StoreBytes: uint64(len(torn))}}, log.Recovery())
+
+	offset, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), offset)
+
+	read, err := log.Read(offset)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), read.Value)
+}
+
+func testRecoverTornSealed(t *testing.T, dir string, c Config) {
+	// Segments 0 and 3 are sealed and 6 is active.
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 6)
+	require.NoError(t, log.Close())
+
+	torn := make([]byte, headerWidth+4)
+	enc.PutUint64(torn, 100)
+	name := log.segments[0].store.Name()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(torn)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	info, err := os.Stat(name)
+	require.NoError(t, err)
+	size := info.Size()
+
+	// Reading the whole store, the way the log's Reader and
+	// compaction do, stops at the last good record.
+	check := func(log *Log) {
+		b, err := ioutil.ReadAll(log.Reader())
+		require.NoError(t, err)
+		require.NotEmpty(t, b)
+		require.NoError(t, log.segments[0].walk(func(*api.Record, uint64) error {
+			return nil
+		}))
+		for offset := uint64(0); offset < 6; offset++ {
+			read, err := log.Read(offset)
+			require.NoError(t, err)
+			require.Equal(t, offset, read.Offset)
+		}
+	}
+
+	// A read-only log leaves the file as it is.
+	log, err = OpenReadOnly(dir)
+	require.NoError(t, err)
+	check(log)
+	require.NoError(t, log.Close())
+	info, err = os.Stat(name)
+	require.NoError(t, err)
+	require.Equal(t, size, info.Size())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, []RecoveryReport{{StoreBytes: uint64(len(torn))}}, log.Recovery())
+	require.True(t, log.segments[0].store.isSealed())
+	check(log)
+	_, err = log.Compact()
+	require.NoError(t, err)
+	info, err = os.Stat(name)
+	require.NoError(t, err)
+	require.Equal(t, size-int64(len(torn)), info.Size())
+}
+
+func testRecoverShortStore(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 3)
+	require.NoError(t, log.Close())
+
+	// Cut the last record in half. All three records are the same
+	// size so the last one starts two thirds of the way past the
+	// store's header.
+	s := log.activeSegment.store
+	position := storeHeaderWidth + (s.size-storeHeaderWidth)/3*2
+	require.NoError(t, os.Truncate(s.Name(), int64(position+headerWidth+2)))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, []RecoveryReport{{
+		IndexEntries: 1,
+		StoreBytes:   headerWidth + 2,
+	}}, log.Recovery())
+
+	offset, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), offset)
+
+	_, err = log.Read(2)
+	require.Error(t, err)
+}
+
+// Small segments make the log roll, so the deleted
+// index belongs to a sealed segment.
+func testRecoverMissingIndex(t *testing.T, dir string, c Config) {
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 6)
+	require.NoError(t, log.Close())
+
+	sealed := log.segments[0]
+	require.NotEqual(t, sealed, log.activeSegment)
+	require.NoError(t, os.Remove(sealed.index.Name()))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	records := sealed.nextOffset - sealed.baseOffset
+	require.Equal(t, []RecoveryReport{{RebuiltEntries: records}}, log.Recovery())
+
+	for offset := uint64(0); offset < 6; offset++ {
+		read, err := log.Read(offset)
+		require.NoError(t, err)
+		require.Equal(t, offset, read.Offset)
+	}
+}
+
+// The index holds more entries than the lowered max index size has
+// room for, both as it was written and when it's rebuilt.
+func testRecoverLoweredMax(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 6)
+	require.NoError(t, log.Close())
+
+	c.Segment.MaxIndexBytes = entryWidth * 3
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, log.Recovery())
+	readRecords := func(n uint64) {
+		t.Helper()
+		for offset := uint64(0); offset < n; offset++ {
+			read, err := log.Read(offset)
+			require.NoError(t, err)
+			require.Equal(t, offset, read.Offset)
+		}
+	}
+	readRecords(6)
+
+	// The segment is full, so the log rolls past it.
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+	require.Len(t, log.segments, 2)
+	require.NoError(t, log.Close())
+
+	require.NoError(t, os.Remove(log.segments[0].index.Name()))
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, []RecoveryReport{{RebuiltEntries: 6}}, log.Recovery())
+	readRecords(7)
+}
+
+func testRebuildIndex(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendRecords(t, log, 3)
+
+	// Point the second entry at the wrong record, which the
+	// check made when the log is opened wouldn't notice.
+	enc.PutUint64(log.activeSegment.index.mmap[entryWidth+offsetWidth:], storeHeaderWidth)
+	read, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), read.Offset)
+
+	report, err := log.RebuildIndex(0)
+	require.NoError(t, err)
+	require.Equal(t, RecoveryReport{IndexEntries: 2, RebuiltEntries: 2}, report)
+
+	read, err = log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), read.Offset)
+
+	_, err = log.RebuildIndex(16)
+	require.Error(t, err)
+}
@@ -0,0 +1,132 @@
+package log
+
+import "time"
+
+/*
+	Retention removes whole segments from the start of the log, the
+	same way Truncate does, so the log always stays one contiguous run
+	of offsets. A segment's age is how long it's been since its last
+	record was appended, so a segment only expires once all its
+	records have.
+
+	The active segment is still being appended to and is never removed,
+	even when it alone is over the limits.
+*/
+
+// DeletedSegment describes a segment removed by retention.
+type DeletedSegment struct {
+	// The segment had the offsets from BaseOffset up
+	// to but not including NextOffset.
+	BaseOffset uint64
+	NextOffset uint64
+	// Bytes is how much space the segment's files took up.
+	Bytes uint64
+	// Limit is the retention limit that removed the segment.
+	Limit RetentionLimit
+}
+
+// RetentionLimit names the limit that made retention remove a segment.
+type RetentionLimit int
+
+const (
+	// RetentionMaxAge removed the segment because its last
+	// record was appended longer ago than the max age.
+	RetentionMaxAge RetentionLimit = iota
+	// RetentionMaxBytes removed the segment because the
+	// log's segments took up more than the max bytes.
+	RetentionMaxBytes
+	// RetentionMaxSegments removed the segment because the
+	// log had more segments than the max segments.
+	RetentionMaxSegments
+)
+
+func (r RetentionLimit) String() string {
+	switch r {
+	case RetentionMaxAge:
+		return "max age"
+	case RetentionMaxBytes:
+		return "max bytes"
+	case RetentionMaxSegments:
+		return "max segments"
+	}
+	return "unknown"
+}
+
+// retains reports whether any retention limit is set.
+func (c Config) retains() bool {
+	r := c.Retention
+	return r.MaxAge > 0 || r.MaxBytes > 0 || r.MaxSegments > 0
+}
+
+// retain is run in the background by the cleaner. A segment that
+// fails to be removed is tried again on the next check.
+func (l *Log) retain() {
+	deleted, _ := l.enforceRetention(time.Now())
+
+	if onDelete := l.Config.Retention.OnDelete; onDelete != nil {
+		for _, d := range deleted {
+			onDelete(d)
+		}
+	}
+}
+
+// enforceRetention removes the oldest sealed segments until the log
+// is within its retention limits as of now, returning what it removed.
+func (l *Log) enforceRetention(now time.Time) ([]DeletedSegment, error) {
+	l.compacting.Lock()
+	defer l.compacting.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := l.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	var total uint64
+	for _, s := range l.segments {
+		total += s.size()
+	}
+
+	var deleted []DeletedSegment
+	// The last segment is the active one.
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		limit, ok := l.expired(s, now, total)
+		if !ok {
+			break
+		}
+		d := DeletedSegment{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			Bytes:      s.size(),
+			Limit:      limit,
+		}
+		if err := s.Remove(); err != nil {
+			return deleted, l.fail("remove segment", err)
+		}
+		l.cache.remove(s.baseOffset, s.nextOffset)
+		l.segments = l.segments[1:]
+		total -= d.Bytes
+		deleted = append(deleted, d)
+	}
+
+	return deleted, nil
+}
+
+// expired reports whether the oldest segment s is past a retention
+// limit, and which one, given the total size of the log's segments.
+func (l *Log) expired(s *segment, now time.Time, total uint64) (RetentionLimit, bool) {
+	r := l.Config.Retention
+	switch {
+	case r.MaxSegments > 0 && len(l.segments) > r.MaxSegments:
+		return RetentionMaxSegments, true
+	case r.MaxBytes > 0 && total > r.MaxBytes:
+		return RetentionMaxBytes, true
+	case r.MaxAge > 0 && now.Sub(s.lastAppended) > r.MaxAge:
+		return RetentionMaxAge, true
+	}
+	return 0, false
+}
@@ -0,0 +1,173 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetention(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string, c Config){
+		"max segments":                    testRetentionMaxSegments,
+		"max bytes":                       testRetentionMaxBytes,
+		"max age":                         testRetentionMaxAge,
+		"active segment is never removed": testRetentionKeepsActive,
+		"cleaner runs in the background":  testRetentionBackground,
+		"no limits keeps every segment":   testRetentionNoLimits,
+		"retention after close fails":     testRetentionClosed,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "retention-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			// Three records to a segment, so ten records
+			// make segments 0, 3, 6 and the active 9.
+			c := Config{}
+			c.Segment.MaxIndexBytes = entryWidth * 3
+
+			fn(t, dir, c)
+		})
+	}
+}
+
+func baseOffsets(log *Log) []uint64 {
+	log.mu.RLock()
+	defer log.mu.RUnlock()
+
+	var offsets []uint64
+	for _, s := range log.segments {
+		offsets = append(offsets, s.baseOffset)
+	}
+	return offsets
+}
+
+func testRetentionMaxSegments(t *testing.T, dir string, c Config) {
+	c.Retention.MaxSegments = 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendRecords(t, log, 10)
+
+	deleted, err := log.enforceRetention(time.Now())
+	require.NoError(t, err)
+	require.Len(t, deleted, 2)
+	require.Equal(t, DeletedSegment{
+		BaseOffset: 0,
+		NextOffset: 3,
+		Bytes:      deleted[0].Bytes,
+		Limit:      RetentionMaxSegments,
+	}, deleted[0])
+	require.NotZero(t, deleted[0].Bytes)
+	require.Equal(t, uint64(3), deleted[1].BaseOffset)
+	require.Equal(t, []uint64{6, 9}, baseOffsets(log))
+
+	_, err = os.Stat(log.Dir + "/0.store")
+	require.True(t, os.IsNotExist(err))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), lowest)
+}
+
+func testRetentionMaxBytes(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendRecords(t, log, 10)
+
+	// Room for the two newest segments, the active
+	// one holding a single record.
+	full := log.segments[1].size()
+	log.Config.Retention.MaxBytes = full + log.segments[3].size()
+
+	deleted, err := log.enforceRetention(time.Now())
+	require.NoError(t, err)
+	require.Len(t, deleted, 2)
+	require.Equal(t, RetentionMaxBytes, deleted[0].Limit)
+	require.Equal(t, []uint64{6, 9}, baseOffsets(log))
+}
+
+func testRetentionMaxAge(t *testing.T, dir string, c Config) {
+	c.Retention.MaxAge = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendRecords(t, log, 10)
+
+	// Only the first segment's records are all older than
+	// the max age. Retention stops at the first segment
+	// that isn't expired.
+	now := time.Now()
+	log.segments[0].lastAppended = now.Add(-2 * time.Hour)
+	log.segments[2].lastAppended = now.Add(-2 * time.Hour)
+
+	deleted, err := log.enforceRetention(now)
+	require.NoError(t, err)
+	require.Len(t, deleted, 1)
+	require.Equal(t, RetentionMaxAge, deleted[0].Limit)
+	require.Equal(t, []uint64{3, 6, 9}, baseOffsets(log))
+}
+
+func testRetentionKeepsActive(t *testing.T, dir string, c Config) {
+	c.Retention.MaxBytes = 1
+	c.Retention.MaxAge = time.Nanosecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendRecords(t, log, 10)
+
+	deleted, err := log.enforceRetention(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, deleted, 3)
+	require.Equal(t, []uint64{9}, baseOffsets(log))
+
+	// The log still takes appends and reads.
+	appendRecords(t, log, 1)
+	_, err = log.Read(10)
+	require.NoError(t, err)
+}
+
+func testRetentionBackground(t *testing.T, dir string, c Config) {
+	deletions := make(chan DeletedSegment, 10)
+	c.Retention.MaxSegments = 1
+	c.Retention.CheckInterval = time.Millisecond
+	c.Retention.OnDelete = func(d DeletedSegment) {
+		deletions <- d
+	}
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	appendRecords(t, log, 4)
+
+	select {
+	case d := <-deletions:
+		require.Equal(t, uint64(0), d.BaseOffset)
+		require.Equal(t, RetentionMaxSegments, d.Limit)
+	case <-time.After(time.Second):
+		t.Fatal("segment wasn't removed in the background")
+	}
+	require.NoError(t, log.Close())
+}
+
+func testRetentionNoLimits(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendRecords(t, log, 10)
+
+	deleted, err := log.enforceRetention(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Empty(t, deleted)
+	require.Equal(t, []uint64{0, 3, 6, 9}, baseOffsets(log))
+}
+
+func testRetentionClosed(t *testing.T, dir string, c Config) {
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	_, err = log.enforceRetention(time.Now())
+	require.Equal(t, ErrClosed, err)
+}
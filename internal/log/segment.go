@@ -1,12 +1,15 @@
 package log
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"path"
+	"time"
 
-	api "github.com/jimxshaw/loglib/api/v1"
+	api "github.com/jimxshaw/loglib/api/v2"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // Segment wraps the store and index types and
@@ -28,44 +31,101 @@ type segment struct {
 	// file and the index sizes to the configured limits, which
 	// lets us know when the segment is maxed out.
 	config Config
+	// How the segment was repaired when it was opened, if it was.
+	recovered RecoveryReport
+	// Set once the segment is closed, so iterators
+	// know to stop reading from it.
+	closed bool
+	// Sparse index of the records' append times.
+	timeIndex *timeIndex
+	// Where the segment's files are kept.
+	backend Backend
+	// Store position of the record the last time index entry
+	// was written for, to know when the next one is due.
+	timeIndexed uint64
+	// What the segment reports to the log's metrics
+	// registry, shared with its store and index.
+	metrics *logMetrics
+	// Append time of the segment's last record, which retention
+	// goes by to tell how old the segment is. Records are stamped
+	// no earlier than it, so append times only go forward.
+	lastAppended time.Time
+	// Append time of the segment's first record, which rolling
+	// by age goes by. Zero while the segment is empty.
+	firstAppended time.Time
+}
+
+// Extensions of the files a segment is made of.
+const (
+	storeExt     = ".store"
+	indexExt     = ".index"
+	timeIndexExt = ".timeindex"
+)
+
+// segmentFile returns the name of the segment's file with the given extension.
+func segmentFile(baseOffset uint64, ext string) string {
+	return fmt.Sprintf("%d%s", baseOffset, ext)
 }
 
 // The log calls this when it needs to add a new segment, such as when the
-// current active segment hits its max size.
-func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
+// current active segment hits its max size. The segment reports to the
+// log's metrics, m.
+// If it fails, the files it opened are closed again.
+func newSegment(b Backend, baseOffset uint64, c Config, m *logMetrics) (_ *segment, err error) {
 	s := &segment{
 		baseOffset: baseOffset,
 		config:     c,
+		backend:    b,
+		metrics:    m,
 	}
 
-	var err error
-	// Create the file if it doesn't exist yet.
-	// The append flag makes the operating system append to the
-	// file when writing.
-	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
-		0644,
-	)
+	var files []File
+	defer func() {
+		if err == nil {
+			return
+		}
+		if s.index != nil {
+			s.index.mapping.Unmap()
+		}
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	open := func(ext string) (File, error) {
+		f, err := openSegmentFile(b, segmentFile(baseOffset, ext), c.ReadOnly)
+		if err == nil {
+			files = append(files, f)
+		}
+		return f, err
+	}
+
+	storeFile, err := open(storeExt)
 	if err != nil {
 		return nil, err
 	}
 	if s.store, err = newStore(storeFile); err != nil {
+		var format *UnsupportedFormatError
+		if errors.As(err, &format) {
+			format.Segment = baseOffset
+		}
 		return nil, err
 	}
+	s.store.readOnly = c.ReadOnly
+	s.store.metrics = s.metrics
+	fi, err := storeFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	s.lastAppended = fi.ModTime()
 
-	// Create the file if it doesn't exist yet.
-	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
-		os.O_RDWR|os.O_CREATE,
-		0644,
-	)
+	indexFile, err := open(indexExt)
 	if err != nil {
 		return nil, err
 	}
-	if s.index, err = newIndex(indexFile, c); err != nil {
+	if s.index, err = newIndex(indexFile, b, c); err != nil {
 		return nil, err
 	}
+	s.index.metrics = s.metrics
 
 	// Set the segment's next offset to prepare for the
 	// next appended record.
@@ -82,15 +142,103 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		s.nextOffset = baseOffset + uint64(off) + 1
 	}
 
+	// A missing or damaged index would make the segment look shorter
+	// than it is and lose the records in the store, so rebuild it.
+	ok, err := s.consistent()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if s.recovered, err = s.rebuildIndex(); err != nil {
+			return nil, err
+		}
+	}
+
+	timeIndexFile, err := open(timeIndexExt)
+	if err != nil {
+		return nil, err
+	}
+	if s.timeIndex, err = newTimeIndex(timeIndexFile); err != nil {
+		return nil, err
+	}
+	s.timeIndex.readOnly = c.ReadOnly
+	if err = s.timeIndex.Truncate(s.nextOffset - s.baseOffset); err != nil {
+		return nil, err
+	}
+	s.timeIndexed = s.store.size
+
+	if err = s.loadAppendTimes(); err != nil {
+		return nil, err
+	}
+
+	// Compaction can remove the records at the end of a
+	// sealed segment, so its store keeps where it ended.
+	if s.nextOffset < s.store.compactedNext {
+		s.nextOffset = s.store.compactedNext
+	}
+
 	return s, nil
 }
 
+// openSegmentFile opens one of a segment's files, creating it if it
+// doesn't exist yet. For a read-only log, it opens the file read only
+// instead. The log writing to the files may not have created them yet,
+// or may have removed them, so missing files read as empty.
+func openSegmentFile(b Backend, name string, readOnly bool) (File, error) {
+	if !readOnly {
+		return b.Open(name)
+	}
+	f, err := b.OpenReadOnly(name)
+	if os.IsNotExist(err) {
+		return &memoryFile{memoryData: &memoryData{name: name}, readOnly: true}, nil
+	}
+	return f, err
+}
+
+// loadAppendTimes sets the first and last append times from the
+// segment's records. Records appended before the log stamped them
+// have no append time, so the store's modification time stands in.
+func (s *segment) loadAppendTimes() error {
+	if s.nextOffset == s.baseOffset {
+		return nil
+	}
+	s.firstAppended = s.lastAppended
+
+	// A damaged record is reported when it's read rather than
+	// keeping the segment from being opened.
+	first, _, err := s.readAt(s.baseOffset, s.store.start())
+	if err != nil && !errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	if first != nil && first.AppendTime != nil {
+		s.firstAppended = first.AppendTime.AsTime()
+	}
+
+	last, err := s.Read(s.nextOffset - 1)
+	if err != nil && !errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	if last != nil && last.AppendTime != nil {
+		s.lastAppended = last.AppendTime.AsTime()
+	}
+
+	return nil
+}
+
 // Append writes the record to the segment and returns the newly appended record's offset.
-// The log returns the offset to the API response.
+// The log returns the offset to the API response. If the index is full, the record is
+// taken back out of the store and ErrSegmentFull is returned. If writing to the store
+// or time index fails, it returns a FailedError.
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	current := s.nextOffset
 	record.Offset = current
 
+	appended := time.Now()
+	if appended.Before(s.lastAppended) {
+		appended = s.lastAppended
+	}
+	record.AppendTime = timestamppb.New(appended)
+
 	p, err := proto.Marshal(record)
 	if err != nil {
 		return 0, err
@@ -99,7 +247,7 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	// The segment appends the data to the store and then adds an index entry.
 	_, position, err := s.store.Append(p)
 	if err != nil {
-		return 0, err
+		return 0, &FailedError{Op: "append", Err: err}
 	}
 	if err = s.index.Write(
 		// index offsets are relative to the base offset.
@@ -108,35 +256,122 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 		uint32(s.nextOffset-uint64(s.baseOffset)),
 		position,
 	); err != nil {
-		return 0, nil
+		// Without an index entry the record can't be read, and the
+		// next record's entry would point at the wrong position.
+		if terr := s.store.Truncate(position); terr != nil {
+			return 0, &FailedError{Op: "append", Err: terr}
+		}
+		return 0, err
+	}
+
+	relOffset := s.nextOffset - s.baseOffset
+	if len(s.timeIndex.entries) == 0 ||
+		position >= s.timeIndexed+s.config.Segment.TimeIndexBytes {
+		if err = s.timeIndex.Write(appended.UnixNano(), uint32(relOffset)); err != nil {
+			s.index.Truncate(relOffset)
+			if terr := s.store.Truncate(position); terr != nil {
+				err = terr
+			}
+			return 0, &FailedError{Op: "append", Err: err}
+		}
+		s.timeIndexed = position
 	}
 
 	// Increment the next offset to prep for a future append call.
 	s.nextOffset++
+	s.lastAppended = appended
+	if s.firstAppended.IsZero() {
+		s.firstAppended = appended
+	}
 
 	return current, nil
 }
 
-// Read returns the record for the given offset.
+// errEndOfSegment is returned when a segment has no record at or after
+// an offset, because compaction removed the records at its end.
+var errEndOfSegment = errors.New("log: end of segment")
+
+// Read returns the record for the given offset. If compaction removed
+// it, Read returns the segment's next record instead, or errEndOfSegment
+// if there isn't one.
 func (s *segment) Read(offset uint64) (*api.Record, error) {
+	_, p, err := s.ReadRaw(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &api.Record{}
+	err = proto.Unmarshal(p, record)
+
+	return record, err
+}
+
+// ReadRaw is Read without decoding the record. It returns the
+// record's offset along with its bytes, as they are in the store.
+func (s *segment) ReadRaw(offset uint64) (uint64, []byte, error) {
 	// Translate the absolute index into a relative offset and get
 	// the associated index entry.
-	_, position, err := s.index.Read(int64(offset - s.baseOffset))
+	_, out, position, err := s.index.Search(uint32(offset - s.baseOffset))
+	if err == io.EOF {
+		return 0, nil, errEndOfSegment
+	}
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 
+	offset = s.baseOffset + uint64(out)
+	p, err := s.readRaw(offset, position)
+
+	return offset, p, err
+}
+
+// readAt reads the record with the given offset whose frame starts at
+// the given position in the store. It also returns the position of the
+// next record, so records can be read in order without using the index.
+func (s *segment) readAt(offset, position uint64) (*api.Record, uint64, error) {
+	p, err := s.readRaw(offset, position)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	record := &api.Record{}
+	err = proto.Unmarshal(p, record)
+
+	return record, s.store.nextPosition(position, p), err
+}
+
+// readRaw reads the bytes of the record with the given offset whose
+// frame starts at the given position in the store.
+func (s *segment) readRaw(offset, position uint64) ([]byte, error) {
 	// The segment goes to the record's position in the store
 	// and read the proper amount of data.
 	p, err := s.store.Read(position)
 	if err != nil {
+		// The store only knows where the bad record is in its file,
+		// so fill in which segment and offset it belongs to.
+		var corrupt *CorruptionError
+		if errors.As(err, &corrupt) {
+			corrupt.Segment = s.baseOffset
+			corrupt.Offset = offset
+		}
 		return nil, err
 	}
 
-	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
+	return p, nil
+}
 
-	return record, err
+// seal seals the segment's store once the segment won't be appended
+// to again, mapping it into memory if the log maps sealed stores.
+func (s *segment) seal() error {
+	if err := s.store.seal(); err != nil {
+		return err
+	}
+	if s.config.Segment.MapSealed {
+		// Mapping only makes reads faster, so a store
+		// that can't be mapped is read from its file.
+		s.store.mmap(s.backend)
+	}
+	return nil
 }
 
 // The log uses this to know it needs to create a new segment.
@@ -147,32 +382,115 @@ func (s *segment) IsMaxed() bool {
 		s.index.size >= s.config.Segment.MaxIndexBytes
 }
 
-// This closes the segment and removes the index and store files.
-func (s *segment) Remove() error {
-	if err := s.Close(); err != nil {
+// offsetForTime returns the offset of the segment's first record
+// appended at or after the given time. It returns false if the
+// segment has no such record.
+func (s *segment) offsetForTime(t time.Time) (uint64, bool, error) {
+	offset, position := s.baseOffset, s.store.start()
+	if rel, ok := s.timeIndex.Lookup(t.UnixNano()); ok {
+		if _, out, pos, err := s.index.Search(rel); err == nil {
+			offset, position = s.baseOffset+uint64(out), pos
+		}
+	}
+
+	for position < s.store.size {
+		record, next, err := s.readAt(offset, position)
+		if err != nil {
+			return 0, false, err
+		}
+		if record.AppendTime != nil && !record.AppendTime.AsTime().Before(t) {
+			return record.Offset, true, nil
+		}
+		offset, position = record.Offset+1, next
+	}
+
+	return 0, false, nil
+}
+
+// IsExpired reports whether the segment's first record was appended
+// longer ago than the configured max age, as of now.
+func (s *segment) IsExpired(now time.Time) bool {
+	maxAge := s.config.Segment.MaxAge
+	return maxAge > 0 && !s.firstAppended.IsZero() &&
+		now.Sub(s.firstAppended) >= maxAge
+}
+
+// rollback drops the records from the given offset onwards,
+// making it the segment's next offset again.
+func (s *segment) rollback(offset uint64) error {
+	if offset >= s.nextOffset {
+		return nil
+	}
+
+	rel := offset - s.baseOffset
+	slot, _, position, err := s.index.Search(uint32(rel))
+	if err != nil {
 		return err
 	}
-	if err := os.Remove(s.index.Name()); err != nil {
+	s.index.Truncate(uint64(slot))
+	if err := s.timeIndex.Truncate(rel); err != nil {
 		return err
 	}
-	if err := os.Remove(s.store.Name()); err != nil {
+	if err := s.store.Truncate(position); err != nil {
 		return err
 	}
+	s.nextOffset = offset
+	if s.nextOffset == s.baseOffset {
+		s.firstAppended = time.Time{}
+	}
 
 	return nil
 }
 
-func (s *segment) Close() error {
-	if err := s.index.Close(); err != nil {
+// Sync commits the segment's records to stable storage. The store
+// is synced first so the index never points at records that could
+// be lost in a crash.
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
 		return err
 	}
-	if err := s.store.Close(); err != nil {
+	if err := s.timeIndex.Sync(); err != nil {
 		return err
 	}
 
+	return s.index.Sync()
+}
+
+// This closes the segment and removes the index and store files.
+func (s *segment) Remove() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	for _, ext := range []string{indexExt, timeIndexExt, storeExt} {
+		if err := s.backend.Remove(segmentFile(s.baseOffset, ext)); err != nil {
+			return err
+		}
+	}
+	s.metrics.segmentsRemoved.Inc()
+
 	return nil
 }
 
+// size returns how many bytes of records and index entries the segment has.
+func (s *segment) size() uint64 {
+	return s.store.size + s.index.size
+}
+
+// Close closes the segment's files, all of them even if
+// closing one fails, and returns the first error.
+func (s *segment) Close() error {
+	s.closed = true
+	err := s.index.Close()
+	if terr := s.timeIndex.Close(); err == nil {
+		err = terr
+	}
+	if serr := s.store.Close(); err == nil {
+		err = serr
+	}
+
+	return err
+}
+
 // We take the lesser multiple to make sure we
 // stay under the user's disk capacity.
 // E.g. nearestMultiple(9, 4) == 8
@@ -1,12 +1,12 @@
 package log
 
 import (
-	"io"
+	"errors"
 	"io/ioutil"
 	"os"
 	"testing"
 
-	api "github.com/jimxshaw/loglib/api/v1"
+	api "github.com/jimxshaw/loglib/api/v2"
 	"github.com/stretchr/testify/require"
 )
 
@@ -26,7 +26,7 @@ func TestSegment(t *testing.T) {
 	c.Segment.MaxStoreBytes = 1024
 	c.Segment.MaxIndexBytes = entryWidth * 3
 
-	s, err := newSegment(dir, 16, c)
+	s, err := newSegment(NewDirBackend(dir), 16, c, noMetrics)
 	require.NoError(t, err)
 	require.Equal(t, uint64(16), s.nextOffset, s.nextOffset)
 	require.False(t, s.IsMaxed())
@@ -41,15 +41,19 @@ func TestSegment(t *testing.T) {
 		require.Equal(t, want.Value, got.Value)
 	}
 
+	// The record that doesn't fit in the index
+	// is taken back out of the store.
+	size := s.store.size
 	_, err = s.Append(want)
-	require.Equal(t, io.EOF, err)
+	require.Equal(t, ErrSegmentFull, err)
+	require.Equal(t, size, s.store.size)
 	// Maxed index.
 	require.True(t, s.IsMaxed())
 
 	c.Segment.MaxStoreBytes = uint64(len(want.Value) * 3)
 	c.Segment.MaxIndexBytes = 1024
 
-	s, err = newSegment(dir, 16, c)
+	s, err = newSegment(NewDirBackend(dir), 16, c, noMetrics)
 	require.NoError(t, err)
 	//Maxed store.
 	require.True(t, s.IsMaxed())
@@ -57,7 +61,44 @@ func TestSegment(t *testing.T) {
 	err = s.Remove()
 	require.NoError(t, err)
 
-	s, err = newSegment(dir, 16, c)
+	s, err = newSegment(NewDirBackend(dir), 16, c, noMetrics)
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+// A damaged record should be reported with the segment and offset
+// it was read from. The damaged record isn't the last one, since the
+// last record is checked and dropped if it's damaged when the
+// segment is opened.
+func TestSegmentReadCorrupt(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-corrupt-test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(NewDirBackend(dir), 16, c, noMetrics)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = s.Append(&api.Record{Value: []byte("hello go")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0}, int64(storeHeaderWidth+headerWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = newSegment(NewDirBackend(dir), 16, c, noMetrics)
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.Read(16)
+	var corrupt *CorruptionError
+	require.True(t, errors.As(err, &corrupt))
+	require.Equal(t, uint64(16), corrupt.Segment)
+	require.Equal(t, uint64(16), corrupt.Offset)
+}
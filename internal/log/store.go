@@ -2,50 +2,213 @@ package log
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
-	"os"
+	"hash/crc32"
+	"io"
 	"sync"
+	"sync/atomic"
 )
 
 var (
 	// Sizes and index entries of records are
 	// persisted using this type of encoding.
 	enc = binary.BigEndian
+
+	// Records are checksummed with CRC32C (Castagnoli),
+	// which modern CPUs compute in hardware.
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// Store files start with these magic bytes, followed by the
+	// version of the format they're written in.
+	storeMagic = []byte("LOGS")
 )
 
 const (
 	// Number of bytes used to store
 	// the record's length.
 	lenWidth = 8
+	// Number of bytes used to store
+	// the record's checksum.
+	crcWidth = 4
+	// Every record in the store is framed by its length
+	// followed by its checksum, then the record itself.
+	headerWidth = lenWidth + crcWidth
+
+	// Number of bytes of the store file's header: the magic
+	// bytes and the format version, which are enough to tell
+	// the store's version, then in the current version the
+	// segment's next offset when compaction rewrote the store.
+	storeVersionWidth = 8
+	storeHeaderWidth  = storeVersionWidth + 8
+
+	// Versions of the store's format. Stores written before
+	// records were checksummed have no file header and frame
+	// records by their length alone. Version 2 stores have a
+	// header with just the magic bytes and version. They're
+	// still read, but new stores are always written in the
+	// current version.
+	storeVersionLegacy    = 1
+	storeVersionChecksums = 2
+	storeVersionCurrent   = 3
 )
 
+/*
+	Version 1 stores can't be told apart from later ones by their
+	name, so every later version starts with a header. A version 1
+	store starts with its first record's length instead, and the
+	magic bytes read as a length of over four exabytes, which no
+	version 1 store could have, so any store that doesn't start
+	with them is read as version 1.
+
+	The header is written along with the store's first record, so
+	an empty store file is in the current version. A file too short
+	to hold the header has no records either, e.g. if a crash cut
+	the header short, so it's also treated as empty and the header
+	is written over it.
+
+	Compaction can remove the records at the end of a sealed segment,
+	after which its index can't tell where the segment ended. So since
+	version 3, the store compaction rewrites the segment into keeps the
+	segment's next offset in its header, even if no records are left.
+	Version 2 headers don't have room for it, but compaction always
+	writes the current version.
+*/
+
 type store struct {
 	// Type embedding:
 	// https://go101.org/article/type-embedding.html
-	*os.File
+	File
 
 	mu   sync.Mutex
 	buf  *bufio.Writer
+	end  *appender
 	size uint64
+	// Version of the format the store is written in.
+	version uint32
+	// The next offset of the store's segment when compaction
+	// rewrote it, or zero if it hasn't been.
+	compactedNext uint64
+	// Set for the stores of read-only logs, whose files are never
+	// written to. Truncating only changes how much of the file
+	// the store uses.
+	readOnly bool
+	// Set to 1 once the store's segment is sealed and won't be
+	// appended to again. Reads of a sealed store go straight to
+	// the file, without the lock or a flush. Accessed atomically.
+	sealed uint32
+	// The sealed store's file mapped into memory, if the log maps
+	// sealed stores. Read returns records as views into it.
+	mapping Mapping
+	// What the store reports to its log's metrics registry.
+	metrics *logMetrics
 }
 
-func newStore(f *os.File) (*store, error) {
+// appender writes to the end of the store's file,
+// where the buffered records go when they're flushed.
+type appender struct {
+	File
+	offset int64
+}
+
+func (a *appender) Write(p []byte) (int, error) {
+	n, err := a.File.WriteAt(p, a.offset)
+	a.offset += int64(n)
+	return n, err
+}
+
+// newStore opens the store kept in the given file. If the file is in
+// a format it can't read, it returns an UnsupportedFormatError.
+func newStore(f File) (*store, error) {
 	// Getting the file's current size is important just
 	// in case the store is being re-created from a file that
 	// has existing data. E.g. after this service re-started.
-	file, err := os.Stat(f.Name())
+	file, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 	size := uint64(file.Size())
 
+	version := uint32(storeVersionCurrent)
+	var compactedNext uint64
+	if size < storeVersionWidth {
+		size = 0
+	} else {
+		header := make([]byte, storeHeaderWidth)
+		if size < storeHeaderWidth {
+			header = header[:size]
+		}
+		if _, err = f.ReadAt(header, 0); err != nil {
+			return nil, err
+		}
+		version = storeVersionLegacy
+		if bytes.Equal(header[:len(storeMagic)], storeMagic) {
+			version = enc.Uint32(header[len(storeMagic):storeVersionWidth])
+		}
+		switch {
+		case version == storeVersionLegacy, version == storeVersionChecksums:
+		case version != storeVersionCurrent:
+			return nil, &UnsupportedFormatError{Version: version}
+		case size < storeHeaderWidth:
+			size = 0
+		default:
+			compactedNext = enc.Uint64(header[storeVersionWidth:])
+		}
+	}
+
+	end := &appender{File: f, offset: int64(size)}
 	return &store{
-		File: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
+		File:          f,
+		size:          size,
+		version:       version,
+		compactedNext: compactedNext,
+		buf:           bufio.NewWriter(end),
+		end:           end,
+		metrics:       noMetrics,
 	}, nil
 }
 
+// start returns the position of the store's first record,
+// which is after the file's header if it has one.
+func (s *store) start() uint64 {
+	switch s.version {
+	case storeVersionLegacy:
+		return 0
+	case storeVersionChecksums:
+		return storeVersionWidth
+	}
+	return storeHeaderWidth
+}
+
+// frameWidth returns the width of the frame
+// header in front of each of the store's records.
+func (s *store) frameWidth() uint64 {
+	if s.version == storeVersionLegacy {
+		return lenWidth
+	}
+	return headerWidth
+}
+
+// writeHeader writes the store file's header to an empty store. The
+// caller must hold the lock, unless no one else has the store yet.
+func (s *store) writeHeader() error {
+	header := make([]byte, storeHeaderWidth)
+	copy(header, storeMagic)
+	enc.PutUint32(header[len(storeMagic):storeVersionWidth], s.version)
+	enc.PutUint64(header[storeVersionWidth:], s.compactedNext)
+	if _, err := s.buf.Write(header); err != nil {
+		return err
+	}
+	s.size = storeHeaderWidth
+	return nil
+}
+
+// nextPosition returns the position of the record after
+// the given record, whose frame starts at the position.
+func (s *store) nextPosition(position uint64, p []byte) uint64 {
+	return position + s.frameWidth() + uint64(len(p))
+}
+
 func (s *store) Append(p []byte) (numOfBytes uint64, position uint64, err error) {
 	// Ensure only 1 goroutine can access a variable at
 	// a time to avoid conflicts. This is called mutual exclusion
@@ -57,79 +220,292 @@ func (s *store) Append(p []byte) (numOfBytes uint64, position uint64, err error)
 	// of the return statement is evaluated.
 	defer s.mu.Unlock()
 
+	var written int
+	if s.size < s.start() {
+		if err := s.writeHeader(); err != nil {
+			return 0, 0, err
+		}
+		written = storeHeaderWidth
+	}
+
 	position = s.size
 
 	// Write the length of the record so that when the record is
-	// read the number of bytes to read will be known.
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	// read the number of bytes to read will be known. The checksum
+	// follows it so reads can tell if the record was damaged on disk.
+	header := make([]byte, headerWidth)
+	enc.PutUint64(header[:lenWidth], uint64(len(p)))
+	enc.PutUint32(header[lenWidth:], crc32.Checksum(p, crcTable))
+	if _, err := s.buf.Write(header[:s.frameWidth()]); err != nil {
 		return 0, 0, err
 	}
 
 	// Write to the buffered writer, instead of directly to the file,
 	// will reduce the number of system calls and improve performance.
-	written, err := s.buf.Write(p)
+	n, err := s.buf.Write(p)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	written += lenWidth
-	s.size += uint64(written)
+	n += int(s.frameWidth())
+	s.size += uint64(n)
+	written += n
+	s.metrics.storeWrittenBytes.Add(uint64(written))
 
-	// Number of bytes written, position where the store
-	// holds the record in its file.
+	// Number of bytes written for the record, position where
+	// the store holds the record in its file.
 	// The segment will use this position when it creates
 	// an associated index entry for this record.
-	return uint64(written), position, nil
+	return uint64(n), position, nil
 }
 
+// Read returns the record at the given position. For a mapped
+// store it's a view into the mapping, so it mustn't be modified
+// and is only good until the store is unsealed or closed.
 func (s *store) Read(position uint64) ([]byte, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.mapping != nil {
+		b, err := s.view(position)
+		if err == nil {
+			s.metrics.storeReadBytes.Add(s.frameWidth() + uint64(len(b)))
+		}
+		return b, err
+	}
+	if !s.isSealed() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	width := s.frameWidth()
 
 	// Flush the writer buffer first, in case we try to read
 	// a record that the buffer hasn't flushed to disk yet.
-	if err := s.buf.Flush(); err != nil {
+	if err := s.flushTo(position + width); err != nil {
 		return nil, err
 	}
 
 	// Find out how many bytes we have to read to get the whole record.
 	// Then we retrieve and return that record.
-	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(position)); err != nil {
+	header := make([]byte, width)
+	if _, err := s.File.ReadAt(header, int64(position)); err != nil {
+		return nil, err
+	}
+
+	// A damaged length could send us far past the end of the
+	// file, so check it before allocating anything for the record.
+	size, err := s.recordSize(position, header)
+	if err != nil {
 		return nil, err
 	}
 
-	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(position+lenWidth)); err != nil {
+	if err := s.flushTo(position + width + size); err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	if _, err := s.File.ReadAt(b, int64(position+width)); err != nil {
 		return nil, err
 	}
 
+	if err := s.verify(position, header, b); err != nil {
+		return nil, err
+	}
+	s.metrics.storeReadBytes.Add(width + size)
+
 	// Returns the record stored at the given position.
 	return b, nil
 }
 
+// view returns the record at the given position as a slice of the
+// mapped store, without a read syscall or copying it.
+func (s *store) view(position uint64) ([]byte, error) {
+	data := s.mapping.Bytes()[:s.size]
+	width := s.frameWidth()
+	if position >= s.size {
+		return nil, io.EOF
+	}
+	if s.size-position < width {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	header := data[position : position+width]
+	size, err := s.recordSize(position, header)
+	if err != nil {
+		return nil, err
+	}
+
+	// Capping the view stops appends to it writing to the mapping.
+	start := position + width
+	b := data[start : start+size : start+size]
+	if err := s.verify(position, header, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// recordSize returns the length in the frame header of the record at
+// the given position, checking that the record fits in the store.
+func (s *store) recordSize(position uint64, header []byte) (uint64, error) {
+	size := enc.Uint64(header[:lenWidth])
+	if size > s.size-position-s.frameWidth() {
+		return 0, &CorruptionError{
+			Position: position,
+			Reason:   "record length runs past the end of the store",
+		}
+	}
+	return size, nil
+}
+
+// verify checks the record at the given position against the checksum
+// in its frame header. Version 1 stores have no checksums to check.
+func (s *store) verify(position uint64, header, b []byte) error {
+	if s.version == storeVersionLegacy {
+		return nil
+	}
+	if crc32.Checksum(b, crcTable) != enc.Uint32(header[lenWidth:]) {
+		return &CorruptionError{
+			Position: position,
+			Reason:   "checksum mismatch",
+		}
+	}
+	return nil
+}
+
 // ReadAt reads the length of the byte slice into the byte slice
 // starting at the offset in the store's file. It implements
 // io.ReadAt interface on the store struct.
 func (s *store) ReadAt(p []byte, offset int64) (int, error) {
+	if !s.isSealed() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+
+	if err := s.flushTo(uint64(offset) + uint64(len(p))); err != nil {
+		return 0, err
+	}
+
+	return s.File.ReadAt(p, offset)
+}
+
+// flushTo flushes the writer buffer if it holds any of the bytes
+// before the given position. Reads of bytes already in the file
+// don't wait on a flush, so they keep working even if writing to
+// the file fails. A sealed store has nothing buffered, so it never
+// flushes. Otherwise the caller must hold the lock.
+func (s *store) flushTo(position uint64) error {
+	if position <= uint64(s.end.offset) {
+		return nil
+	}
+	return s.buf.Flush()
+}
+
+// seal flushes the store and marks it sealed, so reads stop taking
+// the lock. It's sealed when the log rolls to a new segment, and
+// must not be appended to again unless it's unsealed first.
+func (s *store) seal() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if err := s.buf.Flush(); err != nil {
-		return 0, err
+		return err
 	}
+	atomic.StoreUint32(&s.sealed, 1)
+	return nil
+}
 
-	return s.File.ReadAt(p, offset)
+// mmap maps the sealed store's file into memory, so reads return
+// views into it. An empty store has nothing to map.
+func (s *store) mmap(b Backend) error {
+	if s.size == 0 {
+		return nil
+	}
+	m, err := b.MapReadOnly(s.File)
+	if err != nil {
+		return err
+	}
+	s.mapping = m
+	return nil
 }
 
-// Close persists any buffered data before closing the file.
-func (s *store) Close() error {
+// unseal makes reads take the lock again, so the store can be
+// appended to, and unmaps it. The caller must make sure no reads
+// are running and no views are in use, e.g. by holding the log's
+// write lock.
+func (s *store) unseal() error {
+	atomic.StoreUint32(&s.sealed, 0)
+	if s.mapping == nil {
+		return nil
+	}
+	err := s.mapping.Unmap()
+	s.mapping = nil
+	return err
+}
+
+func (s *store) isSealed() bool {
+	return atomic.LoadUint32(&s.sealed) == 1
+}
+
+// Sync flushes buffered data and commits the file
+// to stable storage, so a crash won't lose it.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Sync(); err != nil {
+		return err
+	}
+	s.metrics.storeSyncs.Inc()
+
+	return nil
+}
+
+// Truncate drops everything in the store from the given size
+// onwards. Buffered data is flushed first so that it's cut off
+// along with the rest of the file. Truncating a sealed store
+// unseals it, so the same goes as for unseal. A store truncated
+// to nothing is empty, so it's in the current version again.
+func (s *store) Truncate(size uint64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if err := s.unseal(); err != nil {
+		return err
+	}
+	if size == 0 {
+		s.version = storeVersionCurrent
+		s.compactedNext = 0
+	}
+
 	if err := s.buf.Flush(); err != nil {
 		return err
 	}
+	if s.readOnly {
+		s.size = size
+		return nil
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	s.end.offset = int64(size)
+
+	return nil
+}
+
+// Close persists any buffered data before closing the file. The
+// file is closed even if the data can't be written.
+func (s *store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.buf.Flush()
+	if uerr := s.unseal(); err == nil {
+		err = uerr
+	}
+	if cerr := s.File.Close(); err == nil {
+		err = cerr
+	}
 
-	return s.File.Close()
+	return err
 }
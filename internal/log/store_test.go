@@ -1,6 +1,8 @@
 package log
 
 import (
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -10,9 +12,15 @@ import (
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + headerWidth
 )
 
+// framed returns the position of the store's ith record
+// of the test's writes, counting from zero.
+func framed(i uint64) uint64 {
+	return storeHeaderWidth + width*i
+}
+
 func TestStoreAppendRead(t *testing.T) {
 	f, err := ioutil.TempFile("", "store_append_read_test")
 	require.NoError(t, err)
@@ -40,14 +48,14 @@ func testAppend(t *testing.T, s *store) {
 	for i := uint64(1); i < 4; i++ {
 		numOfBytes, position, err := s.Append(write)
 		require.NoError(t, err)
-		require.Equal(t, position+numOfBytes, width*i)
+		require.Equal(t, position+numOfBytes, framed(i))
 	}
 }
 
 func testRead(t *testing.T, s *store) {
 	t.Helper()
 
-	var position uint64
+	position := framed(0)
 
 	for i := uint64(1); i < 4; i++ {
 		read, err := s.Read(position)
@@ -60,14 +68,14 @@ func testRead(t *testing.T, s *store) {
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
 
-	for i, offset := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, lenWidth)
+	for i, offset := uint64(1), int64(framed(0)); i < 4; i++ {
+		b := make([]byte, headerWidth)
 		numOfBytesRead, err := s.ReadAt(b, offset)
 		require.NoError(t, err)
-		require.Equal(t, lenWidth, numOfBytesRead)
+		require.Equal(t, headerWidth, numOfBytesRead)
 		offset += int64(numOfBytesRead)
 
-		size := enc.Uint64(b)
+		size := enc.Uint64(b[:lenWidth])
 		b = make([]byte, size)
 		numOfBytesRead, err = s.ReadAt(b, offset)
 		require.NoError(t, err)
@@ -77,6 +85,100 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+// Flip a bit in a record's payload and in another record's
+// length and check that both reads fail as corruption rather
+// than returning bad data.
+func TestStoreReadCorrupt(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_read_corrupt_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+	require.NoError(t, s.Close())
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{'H'}, int64(framed(0)+headerWidth))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(framed(1)))
+	require.NoError(t, err)
+
+	s, err = newStore(f)
+	require.NoError(t, err)
+
+	for _, position := range []uint64{framed(0), framed(1)} {
+		_, err = s.Read(position)
+		require.True(t, errors.Is(err, ErrCorrupt))
+		var corrupt *CorruptionError
+		require.True(t, errors.As(err, &corrupt))
+		require.Equal(t, position, corrupt.Position)
+	}
+
+	read, err := s.Read(framed(2))
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+}
+
+func TestStoreSealed(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_sealed_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+	require.NoError(t, s.seal())
+
+	// Sealing flushed the records, so reads don't need
+	// the lock a writer would hold.
+	s.mu.Lock()
+	testRead(t, s)
+	testReadAt(t, s)
+	s.mu.Unlock()
+
+	// Truncating unseals the store so it can be appended to.
+	require.NoError(t, s.Truncate(framed(1)))
+	require.False(t, s.isSealed())
+	_, position, err := s.Append(write)
+	require.NoError(t, err)
+	read, err := s.Read(position)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+}
+
+func TestStoreMapped(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_mapped_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+	require.NoError(t, s.seal())
+	require.NoError(t, s.mmap(NewDirBackend(os.TempDir())))
+	require.NotNil(t, s.mapping)
+
+	testRead(t, s)
+	testReadAt(t, s)
+	read, err := s.Read(framed(1))
+	require.NoError(t, err)
+	require.Equal(t, len(read), cap(read))
+	_, err = s.Read(framed(3))
+	require.Equal(t, io.EOF, err)
+
+	// Truncating unmaps the store and reads go to the file again.
+	require.NoError(t, s.Truncate(framed(2)))
+	require.Nil(t, s.mapping)
+	_, position, err := s.Append(write)
+	require.NoError(t, err)
+	read, err = s.Read(position)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	require.NoError(t, s.Close())
+}
+
 func testStoreClose(t *testing.T) {
 	f, err := ioutil.TempFile("", "store_close_test")
 	require.NoError(t, err)
@@ -0,0 +1,107 @@
+package log
+
+import (
+	"context"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+)
+
+/*
+	Consumers that have caught up with the log wait for new records
+	instead of polling for them. The log keeps a channel that it closes
+	every time records are committed and replaces with a new one, which
+	wakes everyone waiting on it at once however many there are.
+
+	Waiters take the channel before checking for new records, so a
+	record appended between the check and the wait still closes the
+	channel they're waiting on and isn't missed.
+*/
+
+// notify wakes everyone waiting for records to be appended. The
+// caller must hold the write lock and have committed the records.
+func (l *Log) notify() {
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// Wait blocks until there are records for the iterator to read, the
+// context is done or the log is closed.
+func (it *Iterator) Wait(ctx context.Context) error {
+	for {
+		it.log.mu.RLock()
+		// A log that failed to reset has no segments.
+		if err := it.log.checkOpen(); err != nil {
+			it.log.mu.RUnlock()
+			return err
+		}
+		appended := it.log.appended
+		closing := it.log.closing
+		next := it.log.activeSegment.nextOffset
+		it.log.mu.RUnlock()
+
+		if it.err != nil || it.offset < next {
+			return nil
+		}
+
+		select {
+		case <-appended:
+		case <-closing:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Subscription delivers records from the log as they're appended.
+type Subscription struct {
+	records chan *api.Record
+	err     error
+}
+
+// Subscribe returns a subscription that delivers every record from
+// the given offset onwards, waiting for new records once it reaches
+// the end of the log. It stops when the context is done, the log is
+// closed or reading fails.
+func (l *Log) Subscribe(ctx context.Context, from uint64) *Subscription {
+	sub := &Subscription{
+		records: make(chan *api.Record),
+	}
+	go sub.run(ctx, l.Iterator(from))
+	return sub
+}
+
+func (s *Subscription) run(ctx context.Context, it *Iterator) {
+	defer close(s.records)
+
+	for {
+		for it.Next() {
+			select {
+			case s.records <- it.Record():
+			case <-ctx.Done():
+				s.err = ctx.Err()
+				return
+			}
+		}
+		if err := it.Err(); err != nil {
+			s.err = err
+			return
+		}
+		if err := it.Wait(ctx); err != nil {
+			s.err = err
+			return
+		}
+	}
+}
+
+// Records returns the channel records are delivered on. It's closed
+// when the subscription stops, after which Err says why.
+func (s *Subscription) Records() <-chan *api.Record {
+	return s.records
+}
+
+// Err returns why the subscription stopped. It's only
+// safe to call once the records channel is closed.
+func (s *Subscription) Err() error {
+	return s.err
+}
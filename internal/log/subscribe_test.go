@@ -0,0 +1,172 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	api "github.com/jimxshaw/loglib/api/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"receives existing and new records":   testSubscribeFollow,
+		"many subscribers":                    testSubscribeMany,
+		"cancelling the context stops it":     testSubscribeCancel,
+		"closing the log stops subscribers":   testSubscribeClose,
+		"wait returns once records are there": testIteratorWait,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "subscribe-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 64
+
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			fn(t, log)
+		})
+	}
+}
+
+// requireReceives checks that the subscription
+// delivers the records with offsets [from, to).
+func requireReceives(t *testing.T, sub *Subscription, from, to uint64) {
+	t.Helper()
+	require.NoError(t, receive(sub, from, to))
+}
+
+// receive is requireReceives for other goroutines than the test's,
+// which can't fail it, so it returns what went wrong instead.
+func receive(sub *Subscription, from, to uint64) error {
+	for offset := from; offset < to; offset++ {
+		select {
+		case record, ok := <-sub.Records():
+			if !ok {
+				return fmt.Errorf("subscription stopped: %v", sub.Err())
+			}
+			if record.Offset != offset {
+				return fmt.Errorf("received offset %d, want %d", record.Offset, offset)
+			}
+		case <-time.After(time.Second):
+			return fmt.Errorf("timed out waiting for offset %d", offset)
+		}
+	}
+	return nil
+}
+
+// appendInBackground appends the records numbered [from, to) in
+// another goroutine and sends back the first error, if any.
+func appendInBackground(log *Log, from, to uint64) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		for i := from; i < to; i++ {
+			record := &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}
+			if _, err := log.Append(record); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	return errs
+}
+
+func testSubscribeFollow(t *testing.T, log *Log) {
+	appendNumbered(t, log, 0, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := log.Subscribe(ctx, 1)
+	requireReceives(t, sub, 1, 3)
+
+	appended := appendInBackground(log, 3, 10)
+	requireReceives(t, sub, 3, 10)
+	require.NoError(t, <-appended)
+}
+
+func testSubscribeMany(t *testing.T, log *Log) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		sub := log.Subscribe(ctx, 0)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- receive(sub, 0, 5)
+		}()
+	}
+
+	appendNumbered(t, log, 0, 5)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func testSubscribeCancel(t *testing.T, log *Log) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := log.Subscribe(ctx, 0)
+	cancel()
+
+	_, ok := <-sub.Records()
+	require.False(t, ok)
+	require.Equal(t, context.Canceled, sub.Err())
+}
+
+func testSubscribeClose(t *testing.T, log *Log) {
+	sub := log.Subscribe(context.Background(), 0)
+	require.NoError(t, log.Close())
+
+	_, ok := <-sub.Records()
+	require.False(t, ok)
+	require.Equal(t, ErrClosed, sub.Err())
+}
+
+func testIteratorWait(t *testing.T, log *Log) {
+	it := log.Iterator(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, it.Wait(ctx))
+
+	appended := appendInBackground(log, 0, 1)
+	require.NoError(t, it.Wait(context.Background()))
+	require.NoError(t, <-appended)
+	require.True(t, it.Next())
+}
+
+// A log that fails to reset is left closed, so waiting
+// on it fails rather than finding no segments.
+func TestWaitAfterFailedReset(t *testing.T) {
+	b := NewFaultBackend(NewMemoryBackend())
+	log, err := NewLogWithBackend(b, Config{})
+	require.NoError(t, err)
+	appendNumbered(t, log, 0, 1)
+
+	it := log.Iterator(1)
+	b.Inject(Fault{Op: OpOpen, Ext: storeExt, Err: syscall.EIO})
+	require.ErrorIs(t, log.Reset(), syscall.EIO)
+
+	require.Equal(t, ErrClosed, it.Wait(context.Background()))
+	require.False(t, it.Next())
+	require.Equal(t, ErrClosed, it.Err())
+
+	sub := log.Subscribe(context.Background(), 0)
+	_, ok := <-sub.Records()
+	require.False(t, ok)
+	require.Equal(t, ErrClosed, sub.Err())
+}
@@ -0,0 +1,136 @@
+package log
+
+import (
+	"sort"
+)
+
+var (
+	// A time index entry is the record's append time in
+	// nanoseconds since the Unix epoch followed by its
+	// offset relative to the segment's base offset.
+	timestampWidth uint64 = 8
+	timeEntryWidth        = timestampWidth + offsetWidth
+)
+
+/*
+	The time index is sparse. It has an entry for a segment's first
+	record and then one every so many bytes of records, so it stays
+	small enough to keep in memory. Append times only go forward, so
+	to find the first record at or after a time the segment starts
+	from the last entry before that time and reads records in order
+	from there.
+
+	The time index only speeds up lookups and the records in the
+	store have their append times, so entries that don't match the
+	store, such as ones written after the last record the index has,
+	are dropped when the segment is opened.
+*/
+
+type timeEntry struct {
+	timestamp int64
+	offset    uint32
+}
+
+type timeIndex struct {
+	file    File
+	entries []timeEntry
+	// Set for the time indexes of read-only logs, whose files
+	// are never written to.
+	readOnly bool
+}
+
+// newTimeIndex loads the entries in the given file. Bytes past the
+// last whole entry, from a write cut short, are written over by
+// the next entry.
+func newTimeIndex(f File) (*timeIndex, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, fi.Size())
+	if _, err = f.ReadAt(b, 0); err != nil {
+		return nil, err
+	}
+
+	t := &timeIndex{file: f}
+	for pos := uint64(0); pos+timeEntryWidth <= uint64(len(b)); pos += timeEntryWidth {
+		e := timeEntry{
+			timestamp: int64(enc.Uint64(b[pos : pos+timestampWidth])),
+			offset:    enc.Uint32(b[pos+timestampWidth : pos+timeEntryWidth]),
+		}
+		if n := len(t.entries); n > 0 {
+			last := t.entries[n-1]
+			if e.offset <= last.offset || e.timestamp < last.timestamp {
+				break
+			}
+		}
+		t.entries = append(t.entries, e)
+	}
+
+	return t, nil
+}
+
+// Write appends an entry for the record with the given append
+// time and relative offset.
+func (t *timeIndex) Write(timestamp int64, offset uint32) error {
+	b := make([]byte, timeEntryWidth)
+	enc.PutUint64(b[:timestampWidth], uint64(timestamp))
+	enc.PutUint32(b[timestampWidth:], offset)
+
+	pos := int64(uint64(len(t.entries)) * timeEntryWidth)
+	if _, err := t.file.WriteAt(b, pos); err != nil {
+		return err
+	}
+	t.entries = append(t.entries, timeEntry{timestamp: timestamp, offset: offset})
+
+	return nil
+}
+
+// Lookup returns the relative offset of the last entry appended
+// before the given time, which is where to start reading records
+// to find the first one at or after it. It returns false if every
+// entry is at or after the given time.
+func (t *timeIndex) Lookup(timestamp int64) (offset uint32, ok bool) {
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].timestamp >= timestamp
+	})
+	if i == 0 {
+		return 0, false
+	}
+	return t.entries[i-1].offset, true
+}
+
+// Truncate drops the entries for the given relative offset onwards.
+func (t *timeIndex) Truncate(entries uint64) error {
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return uint64(t.entries[i].offset) >= entries
+	})
+	t.entries = t.entries[:i]
+	if t.readOnly {
+		return nil
+	}
+	return t.file.Truncate(int64(uint64(i) * timeEntryWidth))
+}
+
+// Sync commits the entries to stable storage.
+func (t *timeIndex) Sync() error {
+	return t.file.Sync()
+}
+
+// Close truncates the file to the entries it has, dropping
+// any bytes of a write that was cut short, and closes it
+// even if that fails.
+func (t *timeIndex) Close() error {
+	if t.readOnly {
+		return t.file.Close()
+	}
+	err := t.file.Truncate(int64(uint64(len(t.entries)) * timeEntryWidth))
+	if cerr := t.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (t *timeIndex) Name() string {
+	return t.file.Name()
+}
@@ -0,0 +1,69 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "timeindex_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	idx, err := newTimeIndex(f)
+	require.NoError(t, err)
+	require.Equal(t, f.Name(), idx.Name())
+
+	// An empty time index has nowhere to start from.
+	_, ok := idx.Lookup(100)
+	require.False(t, ok)
+
+	require.NoError(t, idx.Write(100, 0))
+	require.NoError(t, idx.Write(200, 5))
+	require.NoError(t, idx.Write(300, 9))
+
+	for _, tc := range []struct {
+		timestamp int64
+		offset    uint32
+		ok        bool
+	}{
+		{timestamp: 50, ok: false},
+		{timestamp: 100, ok: false},
+		{timestamp: 150, offset: 0, ok: true},
+		{timestamp: 200, offset: 0, ok: true},
+		{timestamp: 201, offset: 5, ok: true},
+		{timestamp: 1000, offset: 9, ok: true},
+	} {
+		offset, ok := idx.Lookup(tc.timestamp)
+		require.Equal(t, tc.ok, ok, tc.timestamp)
+		require.Equal(t, tc.offset, offset, tc.timestamp)
+	}
+
+	// Truncating drops the entries for the records from
+	// the given relative offset onwards.
+	require.NoError(t, idx.Truncate(6))
+	require.Len(t, idx.entries, 2)
+
+	// A write cut short leaves part of an entry,
+	// which is ignored when the file is opened.
+	_, err = f.WriteAt([]byte{1, 2, 3}, int64(2*timeEntryWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newTimeIndex(f)
+	require.NoError(t, err)
+	require.Equal(t, []timeEntry{
+		{timestamp: 100, offset: 0},
+		{timestamp: 200, offset: 5},
+	}, idx.entries)
+
+	require.NoError(t, idx.Close())
+	fi, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(2*timeEntryWidth), fi.Size())
+}
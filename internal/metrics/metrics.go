@@ -0,0 +1,285 @@
+// Package metrics keeps counters, gauges and histograms and writes
+// them out in the Prometheus text format, so they can be scraped by
+// Prometheus or anything else that reads the format without the
+// code being measured depending on a metrics library.
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Labels are the label names and values that tell apart the series
+// of a metric, e.g. which log a counter is for.
+type Labels map[string]string
+
+// String returns the labels as they're written out, sorted by name,
+// e.g. {dir="/var/log"}, or an empty string if there are none.
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(l[name]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Counter is a count that only goes up, e.g. of records appended.
+// A nil counter counts nothing, so code can be instrumented whether
+// or not anything's collecting its metrics.
+type Counter struct {
+	n uint64
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds n to the counter.
+func (c *Counter) Add(n uint64) {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.n, n)
+}
+
+// Value returns the count.
+func (c *Counter) Value() uint64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&c.n)
+}
+
+// Gauge is a value that goes up and down, e.g. the size of a
+// queue. Like a counter, a nil gauge does nothing.
+type Gauge struct {
+	bits uint64
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64) {
+	if g == nil {
+		return
+	}
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Add adds v, which can be negative, to the gauge.
+func (g *Gauge) Add(v float64) {
+	if g == nil {
+		return
+	}
+	addFloat(&g.bits, v)
+}
+
+// Value returns the gauge's value.
+func (g *Gauge) Value() float64 {
+	if g == nil {
+		return 0
+	}
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// DefaultBuckets are the upper bounds of histogram buckets for
+// latencies in seconds, from 10µs to 1s.
+var DefaultBuckets = []float64{
+	.00001, .000025, .00005, .0001, .00025, .0005,
+	.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1,
+}
+
+// Histogram counts observations, e.g. latencies, in buckets by
+// their value, along with their count and sum. A nil histogram
+// does nothing.
+type Histogram struct {
+	// Upper bounds of the buckets, in increasing order. Values
+	// past the last one are only counted in the total.
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sumBits uint64
+}
+
+// Observe adds the value to the histogram.
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	addFloat(&h.sumBits, v)
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Start returns the time to pass to ObserveSince once what's being
+// timed is done. A nil histogram doesn't need it, so it returns the
+// zero time without reading the clock.
+func (h *Histogram) Start() time.Time {
+	if h == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// ObserveSince adds the time since start, in seconds.
+func (h *Histogram) ObserveSince(start time.Time) {
+	if h == nil {
+		return
+	}
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Count returns the number of values observed.
+func (h *Histogram) Count() uint64 {
+	if h == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&h.count)
+}
+
+// addFloat atomically adds v to the float64 stored as bits.
+func addFloat(bits *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(bits, old, sum) {
+			return
+		}
+	}
+}
+
+// Registry holds the metrics to write out. Metrics are registered by
+// name and labels, and registering the same ones again returns the
+// metric already registered, so a log that's reopened keeps counting
+// where it left off.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// family is a metric's series, one for each set of labels.
+type family struct {
+	name   string
+	help   string
+	typ    string
+	series map[string]*series
+}
+
+type series struct {
+	// The series' labels as they're written out.
+	labels    string
+	counter   *Counter
+	gauge     *Gauge
+	gaugeFunc func() float64
+	histogram *Histogram
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Counter returns the counter with the given name and labels,
+// registering it if it isn't already.
+func (r *Registry) Counter(name, help string, labels Labels) *Counter {
+	var c *Counter
+	r.register(name, help, "counter", labels, func(s *series) {
+		if s.counter == nil {
+			s.counter = &Counter{}
+		}
+		c = s.counter
+	})
+	return c
+}
+
+// Gauge returns the gauge with the given name and labels,
+// registering it if it isn't already.
+func (r *Registry) Gauge(name, help string, labels Labels) *Gauge {
+	var g *Gauge
+	r.register(name, help, "gauge", labels, func(s *series) {
+		if s.gauge == nil {
+			s.gauge = &Gauge{}
+		}
+		g = s.gauge
+	})
+	return g
+}
+
+// GaugeFunc registers a gauge whose value is whatever fn returns when
+// the metrics are written out, e.g. the number of segments a log has.
+// It replaces the function registered with the same name and labels,
+// if there is one.
+func (r *Registry) GaugeFunc(name, help string, labels Labels, fn func() float64) {
+	r.register(name, help, "gauge", labels, func(s *series) {
+		s.gaugeFunc = fn
+	})
+}
+
+// Histogram returns the histogram with the given name and labels,
+// registering it with the given bucket upper bounds if it isn't
+// already.
+func (r *Registry) Histogram(name, help string, labels Labels, buckets []float64) *Histogram {
+	var h *Histogram
+	r.register(name, help, "histogram", labels, func(s *series) {
+		if s.histogram == nil {
+			buckets = append([]float64(nil), buckets...)
+			sort.Float64s(buckets)
+			s.histogram = &Histogram{
+				buckets: buckets,
+				counts:  make([]uint64, len(buckets)),
+			}
+		}
+		h = s.histogram
+	})
+	return h
+}
+
+// register calls fn, with the registry locked, on the series with
+// the given name and labels, registering it if it isn't already. A
+// name can only be used for one type of metric; using it for another
+// is a programming error, so it panics.
+func (r *Registry) register(name, help, typ string, labels Labels, fn func(*series)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ, series: make(map[string]*series)}
+		r.families[name] = f
+	}
+	if f.typ != typ {
+		panic("metrics: " + name + " is already registered as a " + f.typ)
+	}
+
+	key := labels.String()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: key}
+		f.series[key] = s
+	}
+	fn(s)
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, r *Registry){
+		"written in the text format":         testWriteTo,
+		"registering again returns the same": testRegisterAgain,
+		"name is one type of metric":         testTypeConflict,
+		"nil metrics do nothing":             testNil,
+		"served over http":                   testHandler,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t, NewRegistry())
+		})
+	}
+}
+
+// text returns the registry's metrics in the text format.
+func text(t *testing.T, r *Registry) string {
+	t.Helper()
+
+	var b strings.Builder
+	n, err := r.WriteTo(&b)
+	require.NoError(t, err)
+	require.Equal(t, int64(b.Len()), n)
+	return b.String()
+}
+
+func testWriteTo(t *testing.T, r *Registry) {
+	r.Counter("log_appends_total", "Records appended.", Labels{"log": "b"}).Add(2)
+	r.Counter("log_appends_total", "Records appended.", Labels{"log": "a"}).Inc()
+	r.Gauge("log_queue", "Appends waiting.\nMultiline", nil).Set(1.5)
+	r.GaugeFunc("log_segments", "Segments.", Labels{"log": `"quoted"`}, func() float64 { return 3 })
+	h := r.Histogram("log_append_duration_seconds", "Append latency.", Labels{"log": "a"}, []float64{1, 0.1})
+	for _, v := range []float64{0.05, 0.5, 0.5, 2} {
+		h.Observe(v)
+	}
+
+	require.Equal(t, `# HELP log_append_duration_seconds Append latency.
+# TYPE log_append_duration_seconds histogram
+log_append_duration_seconds_bucket{log="a",le="0.1"} 1
+log_append_duration_seconds_bucket{log="a",le="1"} 3
+log_append_duration_seconds_bucket{log="a",le="+Inf"} 4
+log_append_duration_seconds_sum{log="a"} 3.05
+log_append_duration_seconds_count{log="a"} 4
+# HELP log_appends_total Records appended.
+# TYPE log_appends_total counter
+log_appends_total{log="a"} 1
+log_appends_total{log="b"} 2
+# HELP log_queue Appends waiting.\nMultiline
+# TYPE log_queue gauge
+log_queue 1.5
+# HELP log_segments Segments.
+# TYPE log_segments gauge
+log_segments{log="\"quoted\""} 3
+`, text(t, r))
+}
+
+func testRegisterAgain(t *testing.T, r *Registry) {
+	c := r.Counter("log_reads_total", "Reads.", Labels{"log": "a"})
+	c.Inc()
+	require.Same(t, c, r.Counter("log_reads_total", "Reads.", Labels{"log": "a"}))
+	require.NotSame(t, c, r.Counter("log_reads_total", "Reads.", Labels{"log": "b"}))
+
+	// A gauge function registered again replaces the old one.
+	r.GaugeFunc("log_segments", "Segments.", nil, func() float64 { return 1 })
+	r.GaugeFunc("log_segments", "Segments.", nil, func() float64 { return 2 })
+	require.Contains(t, text(t, r), "log_segments 2\n")
+}
+
+func testTypeConflict(t *testing.T, r *Registry) {
+	r.Counter("log_reads_total", "Reads.", nil)
+	require.Panics(t, func() {
+		r.Gauge("log_reads_total", "Reads.", nil)
+	})
+}
+
+func testNil(t *testing.T, r *Registry) {
+	var c *Counter
+	var g *Gauge
+	var h *Histogram
+	c.Inc()
+	g.Add(1)
+	h.Observe(1)
+	require.Zero(t, c.Value())
+	require.Zero(t, g.Value())
+	require.Zero(t, h.Count())
+}
+
+func testHandler(t *testing.T, r *Registry) {
+	r.Counter("log_appends_total", "Records appended.", nil).Add(7)
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+	body, err := ioutil.ReadAll(rec.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "log_appends_total 7\n")
+}
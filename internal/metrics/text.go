@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ContentType is the content type of the Prometheus text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// WriteTo writes every metric in the Prometheus text format, sorted
+// by name and then labels so the output is the same from one scrape
+// to the next.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	// Gauge functions can take locks of their own, e.g. the log's,
+	// so they're called once the registry's lock is released.
+	for _, f := range r.snapshot() {
+		bw.WriteString("# HELP " + f.name + " " + helpEscaper.Replace(f.help) + "\n")
+		bw.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+		for _, s := range f.sorted {
+			s.write(bw, f.name)
+		}
+	}
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// familySnapshot is a copy of a family, with its series sorted.
+type familySnapshot struct {
+	family
+	sorted []series
+}
+
+// snapshot copies the registry's families, sorted by name.
+func (r *Registry) snapshot() []familySnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	families := make([]familySnapshot, 0, len(r.families))
+	for _, f := range r.families {
+		fs := familySnapshot{family: *f}
+		for _, s := range f.series {
+			fs.sorted = append(fs.sorted, *s)
+		}
+		sort.Slice(fs.sorted, func(i, j int) bool {
+			return fs.sorted[i].labels < fs.sorted[j].labels
+		})
+		families = append(families, fs)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+	return families
+}
+
+// write writes the series' samples for the metric with the given name.
+func (s *series) write(w *bufio.Writer, name string) {
+	switch {
+	case s.counter != nil:
+		sample(w, name, s.labels, strconv.FormatUint(s.counter.Value(), 10))
+	case s.gaugeFunc != nil:
+		sample(w, name, s.labels, formatFloat(s.gaugeFunc()))
+	case s.gauge != nil:
+		sample(w, name, s.labels, formatFloat(s.gauge.Value()))
+	case s.histogram != nil:
+		h := s.histogram
+		// Buckets are written out cumulative, each counting
+		// the values up to and including its upper bound.
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			sample(w, name+"_bucket", withLabel(s.labels, "le", formatFloat(le)),
+				strconv.FormatUint(cumulative, 10))
+		}
+		count := h.Count()
+		sample(w, name+"_bucket", withLabel(s.labels, "le", "+Inf"), strconv.FormatUint(count, 10))
+		sample(w, name+"_sum", s.labels, formatFloat(math.Float64frombits(atomic.LoadUint64(&h.sumBits))))
+		sample(w, name+"_count", s.labels, strconv.FormatUint(count, 10))
+	}
+}
+
+func sample(w *bufio.Writer, name, labels, value string) {
+	w.WriteString(name + labels + " " + value + "\n")
+}
+
+// withLabel adds a label to labels written out by Labels.String.
+func withLabel(labels, name, value string) string {
+	label := name + `="` + labelEscaper.Replace(value) + `"`
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Handler returns an HTTP handler that serves the registry's
+// metrics for Prometheus to scrape, e.g. on /metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		r.WriteTo(w)
+	})
+}
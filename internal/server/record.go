@@ -0,0 +1,30 @@
+package server
+
+import (
+	api "github.com/jimxshaw/loglib/api/v1"
+	apiv2 "github.com/jimxshaw/loglib/api/v2"
+)
+
+// The service speaks v1 and the log stores v2 records. A v1 record
+// has a subset of a v2 record's fields, so producing a v1 record
+// leaves the rest unset and consuming one drops them.
+
+func toV2(record *api.Record) *apiv2.Record {
+	if record == nil {
+		return nil
+	}
+	return &apiv2.Record{
+		Value:  record.Value,
+		Offset: record.Offset,
+	}
+}
+
+func fromV2(record *apiv2.Record) *api.Record {
+	if record == nil {
+		return nil
+	}
+	return &api.Record{
+		Value:  record.Value,
+		Offset: record.Offset,
+	}
+}
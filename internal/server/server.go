@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	api "github.com/jimxshaw/loglib/api/v1"
+	apiv2 "github.com/jimxshaw/loglib/api/v2"
+	"github.com/jimxshaw/loglib/internal/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Config holds what the server depends on. Depending on the
+// CommitLog interface rather than the log itself means the
+// server can be handed any log implementation, e.g. in tests.
+type Config struct {
+	CommitLog CommitLog
+}
+
+// CommitLog is the part of the log the server uses.
+type CommitLog interface {
+	Append(*apiv2.Record) (uint64, error)
+	Read(uint64) (*apiv2.Record, error)
+	Subscribe(ctx context.Context, from uint64) *log.Subscription
+}
+
+var _ api.LogServer = (*grpcServer)(nil)
+
+type grpcServer struct {
+	api.UnimplementedLogServer
+	*Config
+}
+
+// NewGRPCServer creates a gRPC server and registers the
+// log service on it, ready to be served on a listener.
+func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
+	gsrv := grpc.NewServer(opts...)
+	srv, err := newgrpcServer(config)
+	if err != nil {
+		return nil, err
+	}
+	api.RegisterLogServer(gsrv, srv)
+	return gsrv, nil
+}
+
+func newgrpcServer(config *Config) (*grpcServer, error) {
+	return &grpcServer{Config: config}, nil
+}
+
+// Produce appends the request's record and responds with its offset.
+// A request without a record fails with InvalidArgument.
+func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "produce request has no record")
+	}
+	offset, err := s.CommitLog.Append(toV2(req.Record))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &api.ProduceResponse{Offset: offset}, nil
+}
+
+// Consume responds with the record at the requested offset.
+func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	record, err := s.CommitLog.Read(req.Offset)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &api.ConsumeResponse{Record: fromV2(record)}, nil
+}
+
+// ProduceStream appends every record the client sends, responding
+// to each with its offset, until the client closes the stream.
+func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		res, err := s.Produce(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
+
+// ConsumeStream sends every record from the requested offset onwards.
+// Once it's caught up it waits for new records rather than ending the
+// stream, until the client cancels it.
+func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	sub := s.CommitLog.Subscribe(stream.Context(), req.Offset)
+	for record := range sub.Records() {
+		if err := stream.Send(&api.ConsumeResponse{Record: fromV2(record)}); err != nil {
+			return err
+		}
+	}
+
+	err := sub.Err()
+	if errors.Is(err, stream.Context().Err()) {
+		return nil
+	}
+	return toStatus(err)
+}
+
+// toStatus turns the log's errors into statuses with the codes
+// clients expect. An out of range error carries the range of
+// offsets the log has, for the client to act on.
+func toStatus(err error) error {
+	var outOfRange *log.OffsetOutOfRangeError
+	if errors.As(err, &outOfRange) {
+		highest := outOfRange.Next
+		if highest > 0 {
+			highest--
+		}
+		return &api.ErrOffsetOutOfRange{
+			Offset:  outOfRange.Offset,
+			Lowest:  outOfRange.Lowest,
+			Highest: highest,
+			Next:    outOfRange.Next,
+		}
+	}
+
+	switch {
+	case errors.Is(err, log.ErrClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, log.ErrReadOnly):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, log.ErrFailed):
+		return status.Error(codes.Internal, err.Error())
+	case errors.Is(err, log.ErrCorrupt):
+		return status.Error(codes.DataLoss, err.Error())
+	}
+	return err
+}